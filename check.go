@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mktange/wado/pkg/wado"
+	"gopkg.in/yaml.v2"
+)
+
+// configProblem is a problem found in the config file, at the given line if known
+type configProblem struct {
+	line    int
+	message string
+	warning bool
+}
+
+// Matches the line numbers in the errors from the yaml parser
+var yamlLineRegex = regexp.MustCompile(`line (\d+): (.*)`)
+
+// Matches the debounces and timeouts given as plain numbers, which are read as milliseconds
+var unitlessDurationRegex = regexp.MustCompile(`\b(debounce|timeout):\s*([1-9][0-9]*)\s*([,}#]|$)`)
+
+// checkConfig reads and validates the config file, and returns the config
+// along with all the problems found in it
+func checkConfig(configPath string) (*config, []configProblem, error) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conf config
+	err = yaml.UnmarshalStrict(content, &conf)
+	if err != nil {
+		return nil, yamlProblems(err), nil
+	}
+
+	problems := []configProblem{}
+	lines := strings.Split(string(content), "\n")
+	for _, problem := range wado.ValidateConfigs(conf.Wados) {
+		problems = append(problems, configProblem{
+			line:    findLine(lines, problem.Instance, problem.Value),
+			message: problem.String(),
+			warning: problem.Warning,
+		})
+	}
+	for i, line := range lines {
+		for _, match := range unitlessDurationRegex.FindAllStringSubmatch(line, -1) {
+			problems = append(problems, configProblem{
+				line:    i + 1,
+				message: fmt.Sprintf("warning: %v of %v has no unit and is read as %vms", match[1], match[2], match[2]),
+				warning: true,
+			})
+		}
+	}
+	return &conf, problems, nil
+}
+
+// yamlProblems splits the error from the yaml parser into a problem per line
+func yamlProblems(err error) []configProblem {
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+
+	problems := []configProblem{}
+	for _, message := range messages {
+		problem := configProblem{message: "error: " + message}
+		if match := yamlLineRegex.FindStringSubmatch(message); match != nil {
+			problem.line, _ = strconv.Atoi(match[1])
+			problem.message = "error: " + match[2]
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// findLine returns the line number of the first line containing the value,
+// searching from the line naming the instance, or 0 if it cannot be found
+func findLine(lines []string, instance string, value string) int {
+	if value == "" {
+		return 0
+	}
+
+	start := 0
+	nameRegex := regexp.MustCompile(`^\s*(- )?\s*name:\s*["']?` + regexp.QuoteMeta(instance) + `["']?\s*$`)
+	for i, line := range lines {
+		if nameRegex.MatchString(line) {
+			start = i
+			break
+		}
+	}
+
+	for _, from := range []int{start, 0} {
+		for i := from; i < len(lines); i++ {
+			if strings.Contains(lines[i], value) {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+func formatProblem(configPath string, problem configProblem) string {
+	if problem.line == 0 {
+		return fmt.Sprintf("%v: %v", configPath, problem.message)
+	}
+	return fmt.Sprintf("%v:%v: %v", configPath, problem.line, problem.message)
+}
+
+func hasErrors(problems []configProblem) bool {
+	for _, problem := range problems {
+		if !problem.warning {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,439 @@
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The names of the ignore files read in every directory
+const (
+	GitIgnoreFile  = ".gitignore"
+	WadoIgnoreFile = ".wadoignore"
+)
+
+// Matcher tells which paths are ignored by the ignore files found in the
+// directories from the root and down to the path. Rules in deeper directories
+// take precedence, and .wadoignore rules take precedence over .gitignore ones.
+type Matcher struct {
+	root      string
+	fileNames []string
+	global    *ignoreFile
+
+	// The ignore files of each directory, read the first time they are needed
+	dirs      map[string]*dirIgnoreFiles
+	dirsMutex *sync.Mutex
+}
+
+// dirIgnoreFiles holds the ignore files read in a directory, along with the
+// stamps of the files when they were read, to tell when they have changed
+type dirIgnoreFiles struct {
+	files  []*ignoreFile
+	stamps []string
+}
+
+type ignoreFile struct {
+	rules []rule
+}
+
+type rule struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// NewMatcher creates a matcher for the paths under the root directory. With
+// gitIgnore, .gitignore files and the global excludes file of git are honored
+// as well as .wadoignore files, and the .git directory is always ignored.
+func NewMatcher(root string, gitIgnore bool) *Matcher {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+
+	m := &Matcher{
+		root:      root,
+		fileNames: []string{WadoIgnoreFile},
+		dirs:      map[string]*dirIgnoreFiles{},
+		dirsMutex: &sync.Mutex{},
+	}
+	if gitIgnore {
+		m.fileNames = []string{GitIgnoreFile, WadoIgnoreFile}
+
+		gitDir, _ := parseRule(".git/")
+		m.global = &ignoreFile{rules: []rule{gitDir}}
+		if path := globalExcludesFile(); path != "" {
+			if global, err := readIgnoreFile(path); err == nil {
+				m.global.rules = append(m.global.rules, global.rules...)
+			}
+		}
+	}
+	return m
+}
+
+// Ignored returns true if the path, or any of the directories it is in, is ignored
+func (m *Matcher) Ignored(path string, isDir bool) bool {
+	path, ok := m.relPath(path)
+	if !ok {
+		return false
+	}
+
+	// Everything in an ignored directory is ignored, no matter the rules for it
+	for i := range path {
+		if path[i] == '/' && m.matches(path[:i], true) {
+			return true
+		}
+	}
+	return m.matches(path, isDir)
+}
+
+// IgnoredDir returns true if the directory is ignored by the rules for it,
+// assuming the directories it is in are not. This is meant for skipping
+// directories while walking down from the root.
+func (m *Matcher) IgnoredDir(path string) bool {
+	path, ok := m.relPath(path)
+	return ok && m.matches(path, true)
+}
+
+// relPath returns the path relative to the root, if it is in the root
+func (m *Matcher) relPath(path string) (string, bool) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+// matches applies all the rules for the path relative to the root, and returns
+// true if the last one matching ignores it
+func (m *Matcher) matches(path string, isDir bool) bool {
+	ignored := false
+	apply := func(file *ignoreFile, rel string) {
+		for _, r := range file.rules {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if r.regex.MatchString(rel) {
+				ignored = !r.negate
+			}
+		}
+	}
+
+	if m.global != nil {
+		apply(m.global, path)
+	}
+	dir := ""
+	for {
+		for _, file := range m.ignoreFiles(dir) {
+			apply(file, path[len(dir):])
+		}
+		next := strings.IndexByte(path[len(dir):], '/')
+		if next < 0 {
+			break
+		}
+		dir = path[:len(dir)+next+1]
+	}
+	return ignored
+}
+
+// ignoreFiles returns the ignore files in the directory, given relative to the
+// root and ending with a slash, or empty for the root itself
+func (m *Matcher) ignoreFiles(dir string) []*ignoreFile {
+	m.dirsMutex.Lock()
+	defer m.dirsMutex.Unlock()
+
+	if cached, ok := m.dirs[dir]; ok {
+		return cached.files
+	}
+
+	cached := &dirIgnoreFiles{files: []*ignoreFile{}, stamps: m.stamps(dir)}
+	for _, name := range m.fileNames {
+		if file, err := readIgnoreFile(filepath.Join(m.root, filepath.FromSlash(dir), name)); err == nil {
+			cached.files = append(cached.files, file)
+		}
+	}
+	m.dirs[dir] = cached
+	return cached.files
+}
+
+// stamps returns the modification time and size of each of the ignore files
+// in the directory, or empty for the ones that do not exist
+func (m *Matcher) stamps(dir string) []string {
+	stamps := []string{}
+	for _, name := range m.fileNames {
+		stamp := ""
+		if info, err := os.Stat(filepath.Join(m.root, filepath.FromSlash(dir), name)); err == nil {
+			stamp = fmt.Sprintf("%v %v", info.ModTime().UnixNano(), info.Size())
+		}
+		stamps = append(stamps, stamp)
+	}
+	return stamps
+}
+
+// Changed drops the rules read from the directory of the path if it is one of
+// the ignore files, so they are read again when needed. It returns true if it was.
+func (m *Matcher) Changed(path string) bool {
+	name := filepath.Base(path)
+	isIgnoreFile := false
+	for _, fileName := range m.fileNames {
+		isIgnoreFile = isIgnoreFile || name == fileName
+	}
+	if !isIgnoreFile {
+		return false
+	}
+
+	dir, ok := m.relPath(filepath.Dir(path))
+	if !ok {
+		if abs, err := filepath.Abs(filepath.Dir(path)); err != nil || abs != m.root {
+			return false
+		}
+		dir = ""
+	} else {
+		dir += "/"
+	}
+
+	m.dirsMutex.Lock()
+	defer m.dirsMutex.Unlock()
+	delete(m.dirs, dir)
+	return true
+}
+
+// Refresh drops the rules read from the directories whose ignore files have
+// changed since, for when the changes to them are not being watched
+func (m *Matcher) Refresh() {
+	m.dirsMutex.Lock()
+	defer m.dirsMutex.Unlock()
+
+	for dir, cached := range m.dirs {
+		if !reflect.DeepEqual(cached.stamps, m.stamps(dir)) {
+			delete(m.dirs, dir)
+		}
+	}
+}
+
+func readIgnoreFile(path string) (*ignoreFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	file := &ignoreFile{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		line = trimTrailingSpaces(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Like git, rules that cannot be parsed are left out
+		if r, err := parseRule(line); err == nil {
+			file.rules = append(file.rules, r)
+		}
+	}
+	return file, scanner.Err()
+}
+
+// trimTrailingSpaces removes the trailing spaces that are not escaped with a backslash
+func trimTrailingSpaces(line string) string {
+	trimmed := strings.TrimRight(line, " ")
+	if strings.HasSuffix(trimmed, "\\") && len(trimmed) < len(line) {
+		trimmed += " "
+	}
+	return trimmed
+}
+
+// parseRule turns a pattern from an ignore file into a rule, following the rules of gitignore
+func parseRule(pattern string) (rule, error) {
+	r := rule{}
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+
+	// Patterns with a slash before the end are relative to the directory of the
+	// ignore file, while the others match at any depth
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	regex := &strings.Builder{}
+	regex.WriteString("^")
+	if !anchored {
+		regex.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			regex.WriteString("(?:.*/)?")
+			i += 2
+		case pattern[i:] == "**" && i > 0 && pattern[i-1] == '/':
+			regex.WriteString(".*")
+			i++
+		case c == '*':
+			regex.WriteString("[^/]*")
+		case c == '?':
+			regex.WriteString("[^/]")
+		case c == '[':
+			class, end, err := parseClass(pattern, i)
+			if err != nil {
+				return r, err
+			}
+			if end < 0 {
+				regex.WriteString(`\[`)
+				continue
+			}
+			regex.WriteString(class)
+			i = end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			regex.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			regex.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	regex.WriteString("$")
+
+	var err error
+	r.regex, err = regexp.Compile(regex.String())
+	return r, err
+}
+
+// The character classes that can be used in brackets, like [[:space:]]
+var posixClasses = map[string]bool{
+	"alnum": true, "alpha": true, "blank": true, "cntrl": true, "digit": true, "graph": true,
+	"lower": true, "print": true, "punct": true, "space": true, "upper": true, "xdigit": true,
+}
+
+// parseClass turns the bracket expression starting at the given index of the
+// pattern into a regex character class. It returns the index of the closing
+// bracket, or -1 if there is none and the bracket is just a character.
+func parseClass(pattern string, start int) (string, int, error) {
+	i := start + 1
+	negate := i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^')
+	if negate {
+		i++
+	}
+
+	items := &strings.Builder{}
+	for first := i; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == ']' && i > first {
+			break
+		}
+
+		if strings.HasPrefix(pattern[i:], "[:") {
+			if end := strings.Index(pattern[i+2:], ":]"); end >= 0 {
+				name := pattern[i+2 : i+2+end]
+				if !posixClasses[name] {
+					return "", 0, fmt.Errorf("invalid character class: %v", name)
+				}
+				items.WriteString("[:" + name + ":]")
+				i += end + 3
+				continue
+			}
+		}
+
+		if c == '\\' && i+1 < len(pattern) {
+			i++
+			c = pattern[i]
+		}
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			i += 2
+			hi := pattern[i]
+			if hi == '\\' && i+1 < len(pattern) {
+				i++
+				hi = pattern[i]
+			}
+			// Like git, a reversed range matches nothing rather than being an error
+			if c <= hi {
+				items.WriteString(classChar(c) + "-" + classChar(hi))
+			}
+			continue
+		}
+		items.WriteString(classChar(c))
+	}
+	if i >= len(pattern) {
+		return "", -1, nil
+	}
+
+	switch {
+	case negate:
+		return "[^/" + items.String() + "]", i, nil
+	case items.Len() == 0:
+		return `[^\x00-\x{10FFFF}]`, i, nil
+	default:
+		return "[" + items.String() + "]", i, nil
+	}
+}
+
+// classChar escapes the characters that are special inside a regex character class
+func classChar(c byte) string {
+	if strings.IndexByte(`\[]^-`, c) >= 0 {
+		return `\` + string(c)
+	}
+	return string(c)
+}
+
+// globalExcludesFile returns the path of the global excludes file of git, as
+// set by core.excludesFile in the global git config, or else the default one
+func globalExcludesFile() string {
+	home, _ := os.UserHomeDir()
+	if path := excludesFileFromConfig(filepath.Join(home, ".gitconfig")); path != "" {
+		if strings.HasPrefix(path, "~/") {
+			path = filepath.Join(home, path[2:])
+		}
+		return path
+	}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home == "" {
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "git", "ignore")
+}
+
+// excludesFileFromConfig reads core.excludesFile from the git config file
+func excludesFileFromConfig(configPath string) string {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.Trim(line, "[] \t"))
+			continue
+		}
+		if section != "core" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && strings.ToLower(strings.TrimSpace(parts[0])) == "excludesfile" {
+			return strings.Trim(strings.TrimSpace(parts[1]), `"`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package ignore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), os.ModePerm))
+}
+
+func Test_ParseRule(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"*.log", "a.log", true},
+		{"*.log", "sub/dir/a.log", true},
+		{"*.log", "a.log.txt", false},
+		{"/build", "build", true},
+		{"/build", "sub/build", false},
+		{"sub/*.go", "sub/a.go", true},
+		{"sub/*.go", "other/sub/a.go", false},
+		{"sub/*.go", "sub/deeper/a.go", false},
+		{"**/foo", "a/b/foo", true},
+		{"**/foo", "foo", true},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**", "a/x/y", true},
+		{"a/**", "a", false},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file10.txt", false},
+		{"file[0-9].txt", "file5.txt", true},
+		{"file[!0-9].txt", "file5.txt", false},
+		{"file[!0-9].txt", "filex.txt", true},
+		{`\#hash`, "#hash", true},
+		{`\!bang`, "!bang", true},
+		{"[[:space:]]x", " x", true},
+		{"[[:space:]]x", "ax", false},
+		{"[![:digit:]].txt", "a.txt", true},
+		{"[![:digit:]].txt", "1.txt", false},
+		{"a[!b]c", "a/c", false},
+		{"[]]", "]", true},
+		{"[a-]", "-", true},
+		{`[\]]x`, "]x", true},
+		{"[z-a].txt", "b.txt", false},
+		{"[z-ab].txt", "b.txt", true},
+		{"[unclosed", "[unclosed", true},
+	}
+
+	for _, c := range cases {
+		r, err := parseRule(c.pattern)
+		require.NoError(t, err, c.pattern)
+		assert.Equal(t, c.match, r.regex.MatchString(c.path), "%v matching %v", c.pattern, c.path)
+	}
+
+	r, err := parseRule("!keep/")
+	require.NoError(t, err)
+	assert.True(t, r.negate)
+	assert.True(t, r.dirOnly)
+
+	_, err = parseRule("[[:nope:]]")
+	assert.Error(t, err)
+}
+
+func Test_IgnoredNested(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	writeFile(t, filepath.Join(tmpDir, ".gitignore"), "# Comment\n*.log\nnode_modules/\n!important.log\n")
+	writeFile(t, filepath.Join(tmpDir, "sub", ".gitignore"), "/local.txt\n!*.log\n")
+	writeFile(t, filepath.Join(tmpDir, ".wadoignore"), "docs/\n")
+
+	m := NewMatcher(tmpDir, true)
+
+	assert.True(t, m.Ignored(filepath.Join(tmpDir, "a.log"), false))
+	assert.False(t, m.Ignored(filepath.Join(tmpDir, "important.log"), false))
+	assert.False(t, m.Ignored(filepath.Join(tmpDir, "a.go"), false))
+
+	// Rules in deeper ignore files take precedence, and are relative to their directory
+	assert.False(t, m.Ignored(filepath.Join(tmpDir, "sub", "a.log"), false))
+	assert.True(t, m.Ignored(filepath.Join(tmpDir, "sub", "local.txt"), false))
+	assert.False(t, m.Ignored(filepath.Join(tmpDir, "local.txt"), false))
+
+	// Everything in an ignored directory is ignored
+	assert.True(t, m.Ignored(filepath.Join(tmpDir, "node_modules"), true))
+	assert.False(t, m.Ignored(filepath.Join(tmpDir, "node_modules"), false))
+	assert.True(t, m.Ignored(filepath.Join(tmpDir, "node_modules", "pkg", "important.log"), false))
+	assert.True(t, m.IgnoredDir(filepath.Join(tmpDir, "sub", "node_modules")))
+
+	assert.True(t, m.Ignored(filepath.Join(tmpDir, ".git", "config"), false))
+	assert.True(t, m.Ignored(filepath.Join(tmpDir, "docs", "a.md"), false))
+
+	// Paths outside of the root are never ignored
+	assert.False(t, m.Ignored(filepath.Join(filepath.Dir(tmpDir), "a.log"), false))
+	assert.False(t, m.Ignored(tmpDir, true))
+}
+
+func Test_IgnoreFileChanged(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	writeFile(t, filepath.Join(tmpDir, "sub", ".gitignore"), "[[:nope:]]\n*.log\n")
+
+	m := NewMatcher(tmpDir, true)
+	assert.True(t, m.Ignored(filepath.Join(tmpDir, "sub", "a.log"), false))
+	assert.False(t, m.Ignored(filepath.Join(tmpDir, "sub", "a.tmp"), false))
+
+	writeFile(t, filepath.Join(tmpDir, "sub", ".gitignore"), "*.tmp\n")
+	assert.True(t, m.Changed(filepath.Join(tmpDir, "sub", ".gitignore")))
+	assert.False(t, m.Ignored(filepath.Join(tmpDir, "sub", "a.log"), false))
+	assert.True(t, m.Ignored(filepath.Join(tmpDir, "sub", "a.tmp"), false))
+	assert.False(t, m.Changed(filepath.Join(tmpDir, "sub", "a.tmp")))
+
+	// Without being told, the changes are picked up when refreshing
+	writeFile(t, filepath.Join(tmpDir, ".wadoignore"), "*.md\n")
+	assert.False(t, m.Ignored(filepath.Join(tmpDir, "a.md"), false))
+	m.Refresh()
+	assert.True(t, m.Ignored(filepath.Join(tmpDir, "a.md"), false))
+}
+
+func Test_IgnoredWithoutGitIgnore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	writeFile(t, filepath.Join(tmpDir, ".gitignore"), "*.log\n")
+	writeFile(t, filepath.Join(tmpDir, ".wadoignore"), "*.tmp\n")
+
+	m := NewMatcher(tmpDir, false)
+	assert.False(t, m.Ignored(filepath.Join(tmpDir, "a.log"), false))
+	assert.False(t, m.Ignored(filepath.Join(tmpDir, ".git", "config"), false))
+	assert.True(t, m.Ignored(filepath.Join(tmpDir, "a.tmp"), false))
+}
+
+func Test_GlobalExcludesFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	home := filepath.Join(tmpDir, "home")
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	writeFile(t, filepath.Join(home, ".gitconfig"), "[user]\n\tname = Someone\n[core]\n\texcludesFile = ~/global-ignore\n")
+	writeFile(t, filepath.Join(home, "global-ignore"), "*.swp\n")
+	assert.Equal(t, filepath.Join(home, "global-ignore"), globalExcludesFile())
+
+	repo := filepath.Join(tmpDir, "repo")
+	writeFile(t, filepath.Join(repo, ".gitignore"), "!keep.swp\n")
+
+	m := NewMatcher(repo, true)
+	assert.True(t, m.Ignored(filepath.Join(repo, "a.swp"), false))
+	assert.False(t, m.Ignored(filepath.Join(repo, "keep.swp"), false))
+}
@@ -50,10 +50,18 @@ func (rm *MapStringFileStats) Clear() {
 
 // Size returns the size of the map
 func (rm *MapStringFileStats) Size() int {
+	rm.RLock()
+	defer rm.RUnlock()
 	return len(rm.internal)
 }
 
-// Range returns the size of the map
+// Range returns a copy of the map, which can be ranged over while the map changes
 func (rm *MapStringFileStats) Range() map[string]*util.FileStats {
-	return rm.internal
+	rm.RLock()
+	defer rm.RUnlock()
+	result := make(map[string]*util.FileStats, len(rm.internal))
+	for key, value := range rm.internal {
+		result[key] = value
+	}
+	return result
 }
@@ -44,6 +44,17 @@ func (rm *MapStringString) Clear() {
 	rm.Unlock()
 }
 
+// Range returns a copy of the map, which can be ranged over while the map changes
+func (rm *MapStringString) Range() map[string]string {
+	rm.RLock()
+	defer rm.RUnlock()
+	result := make(map[string]string, len(rm.internal))
+	for key, value := range rm.internal {
+		result[key] = value
+	}
+	return result
+}
+
 // Size returns the size of the map
 func (rm *MapStringString) Size() int {
 	return len(rm.internal)
@@ -6,11 +6,13 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -18,6 +20,7 @@ import (
 type FileStats struct {
 	Hash        string
 	LastModTime time.Time
+	Mode        os.FileMode
 }
 
 // GetFileStats returns a FileStats struct containing information about the file and content.
@@ -35,10 +38,18 @@ func GetFileStats(fPath string) (*FileStats, error) {
 	return &FileStats{
 		Hash:        hash,
 		LastModTime: fi.ModTime(),
+		Mode:        fi.Mode(),
 	}, nil
 }
 
-// HasChanged checks if a file has changed.
+// IsSpecialFile returns true if the mode is of a file that cannot be read like
+// a regular file, e.g. a socket, named pipe or device
+func IsSpecialFile(mode os.FileMode) bool {
+	return mode&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0
+}
+
+// HasChanged checks if a file has changed. The new stats are nil if the file
+// is gone, and have the same hash if only the mode of the file has changed.
 func HasChanged(fPath string, fs *FileStats) (*FileStats, bool, error) {
 	fi, err := os.Stat(fPath)
 	if os.IsNotExist(err) {
@@ -56,10 +67,20 @@ func HasChanged(fPath string, fs *FileStats) (*FileStats, bool, error) {
 			return &FileStats{
 				Hash:        hash,
 				LastModTime: fi.ModTime(),
+				Mode:        fi.Mode(),
 			}, true, nil
 		}
 	}
 
+	// Only the mode has changed, which the stats with the same hash tell
+	if fi.Mode() != fs.Mode {
+		return &FileStats{
+			Hash:        fs.Hash,
+			LastModTime: fs.LastModTime,
+			Mode:        fi.Mode(),
+		}, true, nil
+	}
+
 	return nil, false, nil
 }
 
@@ -89,6 +110,13 @@ func getReplaceMap() map[rune]string {
 		replaceMap['('] = "\\("
 		replaceMap[')'] = "\\)"
 		replaceMap['*'] = "[^/\\\\]+"
+		replaceMap['?'] = "[^/\\\\]"
+		replaceMap['+'] = "\\+"
+		replaceMap['{'] = "\\{"
+		replaceMap['}'] = "\\}"
+		replaceMap['|'] = "\\|"
+		replaceMap['^'] = "\\^"
+		replaceMap['$'] = "\\$"
 	})
 	return replaceMap
 }
@@ -164,3 +192,88 @@ func GetLowestDirToWatch(glob string) string {
 	}
 	return filepath.ToSlash(filepath.Dir(glob[:idx]))
 }
+
+// IsWatchLimitError returns true if the error was caused by the OS running out
+// of file watches or not supporting them for the given path.
+func IsWatchLimitError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+
+	switch err {
+	case syscall.ENOSPC, syscall.EMFILE, syscall.ENFILE, syscall.ENOSYS, syscall.ENOTSUP:
+		return true
+	}
+	return false
+}
+
+// RelativeToWorkDir returns the path relative to the working directory, if
+// the path is inside of it. Otherwise the path is returned unchanged.
+func RelativeToWorkDir(fPath string) string {
+	if !filepath.IsAbs(fPath) {
+		return fPath
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return fPath
+	}
+	rel, err := filepath.Rel(wd, fPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fPath
+	}
+	return rel
+}
+
+// FindGitDir returns the .git directory of the repository containing the
+// given directory, or an empty string if it is not in a repository. In
+// worktrees and submodules, .git is a file pointing to the actual directory.
+func FindGitDir(dir string) string {
+	root := FindRepoRoot(dir)
+	if root == "" {
+		return ""
+	}
+	gitDir := filepath.Join(root, ".git")
+	if info, err := os.Stat(gitDir); err == nil && info.IsDir() {
+		return gitDir
+	}
+
+	content, err := ioutil.ReadFile(gitDir)
+	if err != nil {
+		return ""
+	}
+	line := strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+	if !strings.HasPrefix(line, "gitdir:") {
+		return ""
+	}
+	linked := filepath.FromSlash(strings.TrimSpace(strings.TrimPrefix(line, "gitdir:")))
+	if !filepath.IsAbs(linked) {
+		linked = filepath.Join(root, linked)
+	}
+	if info, err := os.Stat(linked); err == nil && info.IsDir() {
+		return linked
+	}
+	return ""
+}
+
+// FindRepoRoot returns the root of the working tree containing the given
+// directory, being the closest one with a .git directory or file, or an
+// empty string if it is not in a repository.
+func FindRepoRoot(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
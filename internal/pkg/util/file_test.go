@@ -114,6 +114,28 @@ func Test_CouldDirMatch_DoubleStar(t *testing.T) {
 	assert.Equal(t, false, match)
 }
 
+func Test_CouldDirMatch_SpecialChars(t *testing.T) {
+	reg := GetCouldDirMatchRegex("path/c++/{a|b}/$v^/*.go")
+
+	match, err := CouldDirMatch(reg, "path/c++/{a|b}/$v^")
+	require.NoError(t, err)
+	assert.Equal(t, true, match)
+
+	match, err = CouldDirMatch(reg, "path/cc/a")
+	require.NoError(t, err)
+	assert.Equal(t, false, match)
+
+	reg = GetCouldDirMatchRegex("path/v?/*.go")
+
+	match, err = CouldDirMatch(reg, "path/v1")
+	require.NoError(t, err)
+	assert.Equal(t, true, match)
+
+	match, err = CouldDirMatch(reg, "path/v12")
+	require.NoError(t, err)
+	assert.Equal(t, false, match)
+}
+
 func Test_GetLowestDirToWatch(t *testing.T) {
 	assert.Equal(t, "path/to/my", GetLowestDirToWatch("path/to/my/*_files.go"))
 	assert.Equal(t, "path/to/my", GetLowestDirToWatch("path/to/my/**/*_files.go"))
@@ -123,3 +145,27 @@ func Test_GetLowestDirToWatch(t *testing.T) {
 	assert.Equal(t, "../..", GetLowestDirToWatch("../../**/*/sub/dir/*_files.go"))
 	assert.Equal(t, ".", GetLowestDirToWatch("."))
 }
+
+func Test_FindGitDir(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	tmpDir, err = filepath.EvalSymlinks(tmpDir)
+	require.NoError(t, err)
+
+	repoDir := filepath.Join(tmpDir, "repo")
+	gitDir := filepath.Join(repoDir, ".git")
+	require.NoError(t, os.MkdirAll(filepath.Join(gitDir, "worktrees", "feature"), os.ModePerm))
+	require.NoError(t, os.MkdirAll(filepath.Join(repoDir, "src"), os.ModePerm))
+
+	assert.Equal(t, gitDir, FindGitDir(filepath.Join(repoDir, "src")))
+	assert.Equal(t, repoDir, FindRepoRoot(filepath.Join(repoDir, "src")))
+
+	// Worktrees and submodules have a .git file pointing to the actual directory
+	worktreeDir := filepath.Join(tmpDir, "feature")
+	require.NoError(t, os.Mkdir(worktreeDir, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(worktreeDir, ".git"), []byte("gitdir: ../repo/.git/worktrees/feature\n"), os.ModePerm))
+
+	assert.Equal(t, filepath.Join(gitDir, "worktrees", "feature"), FindGitDir(worktreeDir))
+	assert.Equal(t, worktreeDir, FindRepoRoot(worktreeDir))
+}
@@ -0,0 +1,25 @@
+package util
+
+import "syscall"
+
+// Magic numbers of the filesystems that do not deliver change notifications
+// for modifications made by other machines. Statfs_t.Type is signed and only 32
+// bits on some architectures, so it is compared as uint32.
+var networkFsTypes = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517B:     true, // SMB
+	0xFF534D42: true, // CIFS
+	0xFE534D42: true, // SMB2
+	0x65735546: true, // FUSE (sshfs etc.)
+	0x5346414F: true, // AFS
+	0x01021997: true, // 9P
+}
+
+// IsNetworkFS returns true if the given path is located on a network mounted filesystem
+func IsNetworkFS(fPath string) (bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(fPath, &stat); err != nil {
+		return false, err
+	}
+	return networkFsTypes[uint32(stat.Type)], nil
+}
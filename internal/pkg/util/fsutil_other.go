@@ -0,0 +1,8 @@
+// +build !linux
+
+package util
+
+// IsNetworkFS returns true if the given path is located on a network mounted filesystem
+func IsNetworkFS(fPath string) (bool, error) {
+	return false, nil
+}
@@ -3,16 +3,47 @@
 package util
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 )
 
+// Signals only found on unix, in addition to the ones known by ParseSignal
+var osSignals = map[string]os.Signal{
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
 // HardKill kills the process witht he given PID for real
 func HardKill(pid int) error {
 	return syscall.Kill(-pid, syscall.SIGKILL)
 }
 
+// SignalGroup sends the signal to the whole process group led by the given PID
+func SignalGroup(pid int, signal os.Signal) error {
+	sig, ok := signal.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal: %v", signal)
+	}
+	return syscall.Kill(-pid, sig)
+}
+
+// IsProcessGroupRunning checks if any process in the group led by the given PID is running
+func IsProcessGroupRunning(pid int) bool {
+	if syscall.Kill(-pid, syscall.Signal(0)) != nil {
+		return false
+	}
+
+	// Zombies waiting to be reaped still count as members of the group
+	if live, ok := hasLiveGroupMembers(pid); ok {
+		return live
+	}
+	return true
+}
+
 // IsProcessRunning checks if a given process is running
 func IsProcessRunning(pid int) bool {
 	process, err := os.FindProcess(pid)
@@ -26,3 +57,13 @@ func IsProcessRunning(pid int) bool {
 func SetupCmd(cmd *exec.Cmd) {
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 }
+
+// ShellCommand returns the binary and arguments to run the command in the OS shell
+func ShellCommand(cmd string) (string, []string) {
+	return "sh", []string{"-c", cmd}
+}
+
+// QuoteShellWord quotes a word, so it is kept as one by the OS shell
+func QuoteShellWord(word string) string {
+	return "'" + strings.Replace(word, "'", `'"'"'`, -1) + "'"
+}
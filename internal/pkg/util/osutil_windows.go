@@ -6,12 +6,30 @@ import (
 	"strconv"
 )
 
+// Signals only found on windows, in addition to the ones known by ParseSignal
+var osSignals = map[string]os.Signal{}
+
 // HardKill kills the process witht he given PID for real
 func HardKill(pid int) error {
 	kill := exec.Command("TASKKILL", "/T", "/F", "/PID", strconv.Itoa(pid))
 	return kill.Run()
 }
 
+// SignalGroup sends the signal to the process with the given PID, as windows
+// has no process groups to signal
+func SignalGroup(pid int, signal os.Signal) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Signal(signal)
+}
+
+// IsProcessGroupRunning checks if the process with the given PID is running
+func IsProcessGroupRunning(pid int) bool {
+	return IsProcessRunning(pid)
+}
+
 // IsProcessRunning checks if a given process is running
 func IsProcessRunning(pid int) bool {
 	_, err := os.FindProcess(pid)
@@ -24,3 +42,14 @@ func IsProcessRunning(pid int) bool {
 // SetupCmd sets up a runnable/killable command in the OS
 func SetupCmd(cmd *exec.Cmd) {
 }
+
+// ShellCommand returns the binary and arguments to run the command in the OS shell
+func ShellCommand(cmd string) (string, []string) {
+	return "cmd", []string{"/C", cmd}
+}
+
+// QuoteShellWord quotes a word, so it is kept as one by the OS shell. Windows
+// does not allow double quotes in paths, so they need no escaping.
+func QuoteShellWord(word string) string {
+	return `"` + word + `"`
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// hasLiveGroupMembers checks /proc for processes in the group that are not zombies.
+// The second return value is false if the processes could not be checked.
+func hasLiveGroupMembers(pgid int) (bool, bool) {
+	statFiles, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil || len(statFiles) == 0 {
+		return false, false
+	}
+
+	for _, statFile := range statFiles {
+		content, err := ioutil.ReadFile(statFile)
+		if err != nil {
+			continue
+		}
+
+		// The command name is in parentheses and may contain spaces, so skip past it.
+		// What follows is: state ppid pgrp ...
+		stat := string(content)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) < 3 {
+			continue
+		}
+		group, err := strconv.Atoi(fields[2])
+		if err == nil && group == pgid && fields[0] != "Z" {
+			return true, true
+		}
+	}
+	return false, true
+}
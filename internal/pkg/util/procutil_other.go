@@ -0,0 +1,8 @@
+// +build !linux,!windows
+
+package util
+
+// hasLiveGroupMembers is not supported outside of linux, so the second return value is false
+func hasLiveGroupMembers(pgid int) (bool, bool) {
+	return false, false
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ParseSignal returns the signal with the given name, e.g. "SIGTERM" or "TERM"
+func ParseSignal(name string) (os.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	switch name {
+	case "SIGHUP":
+		return syscall.SIGHUP, nil
+	case "SIGINT":
+		return os.Interrupt, nil
+	case "SIGQUIT":
+		return syscall.SIGQUIT, nil
+	case "SIGKILL":
+		return os.Kill, nil
+	case "SIGTERM":
+		return syscall.SIGTERM, nil
+	}
+
+	if sig, ok := osSignals[name]; ok {
+		return sig, nil
+	}
+	return nil, fmt.Errorf("unknown signal: %v", name)
+}
+
+// SignalName returns the name of the signal as accepted by ParseSignal, e.g. "SIGTERM"
+func SignalName(signal os.Signal) string {
+	for _, name := range []string{"SIGHUP", "SIGINT", "SIGQUIT", "SIGKILL", "SIGTERM"} {
+		if sig, err := ParseSignal(name); err == nil && sig == signal {
+			return name
+		}
+	}
+	for name, sig := range osSignals {
+		if sig == signal {
+			return name
+		}
+	}
+	return signal.String()
+}
@@ -0,0 +1,15 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!windows
+
+package util
+
+import "errors"
+
+// IsTerminal returns false, as terminals are not supported on this OS
+func IsTerminal(fd int) bool {
+	return false
+}
+
+// KeyInput is not supported on this OS
+func KeyInput(fd int) (restore func() error, err error) {
+	return nil, errors.New("key input is not supported")
+}
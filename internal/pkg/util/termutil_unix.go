@@ -0,0 +1,34 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package util
+
+import "golang.org/x/sys/unix"
+
+// IsTerminal returns true if the file descriptor is a terminal
+func IsTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	return err == nil
+}
+
+// KeyInput makes the terminal pass on single key presses instead of whole
+// lines, without echoing them. Signals like Ctrl-C and output processing are
+// left as they are. The returned function restores the terminal.
+func KeyInput(fd int) (restore func() error, err error) {
+	original, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := *original
+	keys.Lflag &^= unix.ICANON | unix.ECHO
+	keys.Cc[unix.VMIN] = 1
+	keys.Cc[unix.VTIME] = 0
+	err = unix.IoctlSetTermios(fd, ioctlSetTermios, &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return unix.IoctlSetTermios(fd, ioctlSetTermios, original)
+	}, nil
+}
@@ -0,0 +1,31 @@
+package util
+
+import "golang.org/x/sys/windows"
+
+// IsTerminal returns true if the file descriptor is a console
+func IsTerminal(fd int) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(fd), &mode) == nil
+}
+
+// KeyInput makes the console pass on single key presses instead of whole
+// lines, without echoing them. Ctrl-C is still processed as usual. The
+// returned function restores the console.
+func KeyInput(fd int) (restore func() error, err error) {
+	handle := windows.Handle(fd)
+	var original uint32
+	err = windows.GetConsoleMode(handle, &original)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := original &^ (windows.ENABLE_LINE_INPUT | windows.ENABLE_ECHO_INPUT)
+	err = windows.SetConsoleMode(handle, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return windows.SetConsoleMode(handle, original)
+	}, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mktange/wado/internal/pkg/util"
+	"github.com/mktange/wado/pkg/wado"
+)
+
+const keysHelp = "[Wado] Keys: r restart all, 1-9 restart an instance, p pause/resume, c clear, q quit"
+
+// keyInput puts the terminal in a mode where key presses are read one at a time.
+// It returns a function restoring the terminal, or nil if stdin is not a terminal.
+func keyInput() func() {
+	fd := int(os.Stdin.Fd())
+	if !util.IsTerminal(fd) {
+		return nil
+	}
+
+	restore, err := util.KeyInput(fd)
+	if err != nil {
+		log.Println("[Wado] Could not read keys from the terminal:", err)
+		return nil
+	}
+
+	return func() {
+		if err := restore(); err != nil {
+			log.Println("[Wado] Could not restore the terminal:", err)
+		}
+	}
+}
+
+// handleKeys reads key presses from the terminal and acts on the group
+func handleKeys(group *wado.Group, quit func()) {
+	log.Println(keysHelp)
+	for i, instance := range group.Instances() {
+		if i < 9 {
+			log.Printf("[Wado]   %v: %v\n", i+1, instance.Name())
+		}
+	}
+
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				return
+			}
+			if n == 1 {
+				handleKey(group, buf[0], quit)
+			}
+		}
+	}()
+}
+
+func handleKey(group *wado.Group, key byte, quit func()) {
+	switch {
+	case key == 'r':
+		log.Println("[Wado] Restarting all instances")
+		go group.Restart()
+	case key >= '1' && key <= '9':
+		instances := group.Instances()
+		i := int(key - '1')
+		if i < len(instances) {
+			log.Printf("[Wado] Restarting %v\n", instances[i].Name())
+			go instances[i].Restart()
+		}
+	case key == 'p':
+		togglePause(group)
+	case key == 'c':
+		fmt.Print("\033[H\033[2J")
+	case key == 'q':
+		log.Println("[Wado] Quitting")
+		quit()
+	}
+}
@@ -1,71 +1,422 @@
 package main
 
 import (
+	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path"
+	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 
+	"github.com/mktange/wado/internal/pkg/util"
 	"github.com/mktange/wado/pkg/wado"
-	"gopkg.in/yaml.v2"
 )
 
-var configFile = flag.String("config", "./wado.yml", "Path to wado.yml")
-
 type config struct {
 	Wados []wado.Config `yaml:"wados"`
 }
 
+const usage = `Usage: wado [command] [-config path/to/wado.yml] [-events json] [args]
+
+Commands:
+  run [names...]  Watch and run the given instances, or all of them (default)
+  list            List the configured instances and their resolved globs
+  once <name>     Run the commands of an instance once, and exit with their status
+  check           Validate the config file and report any problems
+  status          Show the status of the instances of a running wado
+  trigger <name>  Restart an instance of a running wado
+`
+
+// The control socket of a running wado, next to the config file
+const socketName = ".wado.sock"
+
 func main() {
-	flag.Parse()
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	configFile := flags.String("config", "./wado.yml", "Path to wado.yml")
+	events := flags.String("events", "", "Write events to stdout in the given format (json), moving the output of the commands to stderr")
+	args = parseInterspersed(flags, args)
+
+	// With events on stdout, the output of the commands goes to stderr
+	output := io.Writer(os.Stdout)
+	switch *events {
+	case "":
+	case "json":
+		wado.SetEventWriter(os.Stdout)
+		wado.SetOutput(os.Stderr, os.Stderr)
+		output = os.Stderr
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown events format: %v\n", *events)
+		os.Exit(2)
+	}
 
 	dir := path.Dir(*configFile)
 	os.Chdir(dir)
+	configName := path.Base(*configFile)
+
+	exactArgs := func(n int) {
+		if len(args) != n {
+			flags.Usage()
+			os.Exit(2)
+		}
+	}
 
-	yamlFile, err := ioutil.ReadFile(path.Base(*configFile))
+	switch command {
+	case "run":
+		run(configName, args)
+	case "list":
+		exactArgs(0)
+		os.Exit(list(configName))
+	case "once":
+		exactArgs(1)
+		os.Exit(once(configName, args[0], output))
+	case "check":
+		exactArgs(0)
+		os.Exit(check(configName))
+	case "status":
+		exactArgs(0)
+		os.Exit(status())
+	case "trigger":
+		exactArgs(1)
+		os.Exit(trigger(args[0]))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %v\n", command)
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// parseInterspersed parses the flags, also when they come after the other
+// arguments, and returns the other arguments. Everything after -- is taken
+// as arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	rest := []string{}
+	for {
+		flags.Parse(args)
+		parsed := args[:len(args)-flags.NArg()]
+		args = flags.Args()
+		if len(parsed) > 0 && parsed[len(parsed)-1] == "--" {
+			return append(rest, args...)
+		}
+		if len(args) == 0 {
+			return rest
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
+// run starts the instances with the given names, or all of them, and runs until killed
+func run(configName string, names []string) {
+	configs, err := loadSelectedConfigs(configName, names)
 	if err != nil {
-		panic(err)
+		log.Fatalln("[Wado] Could not load the config:", err)
 	}
 
-	var conf config
-	err = yaml.Unmarshal(yamlFile, &conf)
+	group, err := wado.NewGroup(configs)
 	if err != nil {
-		panic(err)
+		log.Fatalln("[Wado] Could not start:", err)
 	}
 
-	wados := []wado.Instance{}
-	for _, wadoConfig := range conf.Wados {
-		instance, err := wado.New(wadoConfig)
+	control, err := wado.ServeControl(group, socketName)
+	if err != nil {
+		log.Println("[Wado] Could not start the control server:", err)
+	}
+
+	err = reloadOnChange(configName, names, group)
+	if err != nil {
+		log.Println("[Wado] Could not watch the config file for changes:", err)
+	}
+
+	// The terminal is only changed once nothing can fail fatally anymore, and
+	// every shutdown from here on restores it
+	restoreTerminal := keyInput()
+	shutdown := shutdownFunc(group, func() {
+		if control != nil {
+			control.Close()
+		}
+		if restoreTerminal != nil {
+			restoreTerminal()
+		}
+	})
+
+	if restoreTerminal != nil {
+		handleKeys(group, func() { shutdown(0) })
+	}
+	pauseOnSignal(group)
+	shutdownOnSignal(shutdown)
+	select {}
+}
+
+// list prints the configured instances with their globs resolved, and returns the exit code
+func list(configName string) int {
+	conf, err := loadConfig(configName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	configs, err := wado.SortByDependencies(conf.Wados)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for i, c := range configs {
+		if i > 0 {
+			fmt.Println()
+		}
+		name := c.Name
+		if name == "" {
+			name = "Wado"
+		}
+		if len(c.DependsOn) > 0 {
+			fmt.Printf("%v (depends on %v)\n", name, strings.Join(c.DependsOn, ", "))
+		} else {
+			fmt.Println(name)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		printGlobs(w, "include", c.IncludeGlobs)
+		printGlobs(w, "exclude", c.ExcludeGlobs)
+		for _, cmd := range c.Cmds {
+			fmt.Fprintf(w, "  cmd:\t%v\n", cmd.Run)
+		}
+		for _, rule := range c.On {
+			printGlobs(w, "on", rule.IncludeGlobs)
+			printGlobs(w, "  exclude", rule.ExcludeGlobs)
+			for _, cmd := range rule.Cmds {
+				fmt.Fprintf(w, "    cmd:\t%v\n", cmd.Run)
+			}
+			if rule.RestartMain {
+				fmt.Fprintf(w, "    restartMain:\ttrue\n")
+			}
+		}
+		w.Flush()
+	}
+	return 0
+}
+
+func printGlobs(w *tabwriter.Writer, label string, globs []string) {
+	resolved, err := wado.ResolveGlobs(globs)
+	if err != nil {
+		resolved = globs
+	}
+	for _, glob := range resolved {
+		fmt.Fprintf(w, "  %v:\t%v\n", label, glob)
+	}
+}
+
+// once runs the commands of the instance once, and returns the exit code of the
+// failed command, or 0 if all of them succeeded
+func once(configName string, name string, output io.Writer) int {
+	configs, err := loadSelectedConfigs(configName, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var instanceConfig *wado.Config
+	for i := range configs {
+		if configs[i].Name == name || (configs[i].Name == "" && name == "Wado") {
+			instanceConfig = &configs[i]
+			break
+		}
+	}
+	if instanceConfig == nil {
+		fmt.Fprintf(os.Stderr, "unknown instance: %v\n", name)
+		return 1
+	}
+
+	chain, err := wado.NewCmdChainFromConfigs(instanceConfig.Cmds...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	chain.SetWriter(output)
+	chain.SetEnv([]string{wado.EnvInstance + "=" + name})
+	chain.SetInstanceName(name)
+
+	err = chain.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	shutdownOnSignal(shutdownFunc(chain))
+
+	result := chain.Wait()
+	if result.Success() {
+		return 0
+	}
+	if step := result.FailedStep(); step != nil && step.ExitCode > 0 {
+		return step.ExitCode
+	}
+	return 1
+}
+
+// check prints all the problems in the config file, and returns the exit code
+func check(configName string) int {
+	_, problems, err := checkConfig(configName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, problem := range problems {
+		fmt.Println(formatProblem(configName, problem))
+	}
+	if hasErrors(problems) {
+		return 1
+	}
+	return 0
+}
+
+// status prints the status of the instances of the running wado, and returns the exit code
+func status() int {
+	statuses, err := wado.NewControlClient(socketName).Status()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not reach a running wado:", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, s := range statuses {
+		state := "idle"
+		if s.Running {
+			state = "running"
+		}
+		if s.Paused {
+			state += ", paused"
+		}
+		fmt.Fprintf(w, "%v\t%v\n", s.Name, state)
+	}
+	w.Flush()
+	return 0
+}
+
+// trigger restarts the instance of the running wado, and returns the exit code
+func trigger(name string) int {
+	err := wado.NewControlClient(socketName).Trigger(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not trigger the instance:", err)
+		return 1
+	}
+	return 0
+}
+
+// loadConfig reads and validates the config file. Warnings are logged, and
+// an error is returned if the config has any errors.
+func loadConfig(configPath string) (*config, error) {
+	conf, problems, err := checkConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, problem := range problems {
+		log.Println("[Wado]", formatProblem(configPath, problem))
+	}
+	if hasErrors(problems) {
+		return nil, errors.New("the config has errors")
+	}
+	return conf, nil
+}
+
+// loadSelectedConfigs loads the config file, and returns the configurations of
+// the instances with the given names and their dependencies
+func loadSelectedConfigs(configPath string, names []string) ([]wado.Config, error) {
+	conf, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return wado.SelectConfigs(conf.Wados, names)
+}
+
+// reloadOnChange watches the config file, and updates the running instances
+// to match it whenever it changes
+func reloadOnChange(configPath string, names []string, group *wado.Group) error {
+	watcher, err := wado.NewPollWatcher([]string{configPath}, []string{}, false, wado.PollConfig{})
+	if err != nil {
+		return err
+	}
+
+	watcher.AddCallback(func(string) {
+		configs, err := loadSelectedConfigs(configPath, names)
 		if err != nil {
-			panic(err)
+			log.Println("[Wado] Not reloading:", err)
+			return
+		}
+
+		log.Println("[Wado] Config changed, reloading")
+		err = group.Update(configs)
+		if err != nil {
+			log.Println("[Wado] Not reloading, the config is invalid:", err)
+		}
+	})
+	return nil
+}
+
+// pauseOnSignal toggles pausing all the instances on SIGUSR1, where it exists
+func pauseOnSignal(group *wado.Group) {
+	sig, err := util.ParseSignal("SIGUSR1")
+	if err != nil {
+		return
+	}
+
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, sig)
+	go func() {
+		for range c {
+			togglePause(group)
 		}
-		wados = append(wados, instance)
+	}()
+}
+
+func togglePause(group *wado.Group) {
+	if group.IsPaused() {
+		log.Println("[Wado] Resuming")
+		group.Resume()
+	} else {
+		log.Println("[Wado] Pausing")
+		group.Pause()
 	}
+}
 
-	shutdownOnSignal(wados)
-	select {}
+// shutdownFunc returns a function that kills the instance, runs the cleanups and
+// exits with the given code. Only the first call has any effect.
+func shutdownFunc(instance interface{ Kill() }, cleanups ...func()) func(code int) {
+	once := &sync.Once{}
+	return func(code int) {
+		once.Do(func() {
+			instance.Kill()
+			for _, cleanup := range cleanups {
+				cleanup()
+			}
+			os.Exit(code)
+		})
+	}
 }
 
-func shutdownOnSignal(instances []wado.Instance) {
+// shutdownOnSignal shuts down when interrupted, terminated or when the terminal is closed
+func shutdownOnSignal(shutdown func(code int)) {
 	c := make(chan os.Signal, 2)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		s := <-c
 		log.Println("[Wado] Got signal: ", s)
-
-		wg := sync.WaitGroup{}
-		for _, instance := range instances {
-			wg.Add(1)
-			go func() {
-				instance.Kill()
-				wg.Done()
-			}()
-		}
-		wg.Wait()
-		os.Exit(1)
+		shutdown(1)
 	}()
 }
@@ -0,0 +1,78 @@
+package wado
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// StepResult holds the outcome of running a single command in a chain
+type StepResult struct {
+	Command  []string
+	ExitCode int
+	Err      error
+	Failed   bool
+	Duration time.Duration
+}
+
+// ChainResult holds the outcome of a run of a command chain
+type ChainResult struct {
+	Steps    []StepResult
+	Killed   bool
+	Duration time.Duration
+}
+
+// Success returns true if the chain ran to the end without any failing commands
+func (r *ChainResult) Success() bool {
+	return !r.Killed && r.FailedStep() == nil
+}
+
+// FailedStep returns the first step that failed, or nil if none did
+func (r *ChainResult) FailedStep() *StepResult {
+	for i := range r.Steps {
+		if r.Steps[i].Failed {
+			return &r.Steps[i]
+		}
+	}
+	return nil
+}
+
+// FailedStepIndex returns the index of the first step that failed, or -1 if none did
+func (r *ChainResult) FailedStepIndex() int {
+	for i := range r.Steps {
+		if r.Steps[i].Failed {
+			return i
+		}
+	}
+	return -1
+}
+
+// String returns a summary line of the result
+func (r *ChainResult) String() string {
+	duration := r.Duration.Round(time.Millisecond)
+	if r.Killed {
+		return fmt.Sprintf("Chain killed after %v", duration)
+	}
+
+	i := r.FailedStepIndex()
+	if i < 0 {
+		return fmt.Sprintf("Chain finished %v steps in %v", len(r.Steps), duration)
+	}
+
+	step := r.Steps[i]
+	return fmt.Sprintf("Chain failed at step %v (%v) with exit code %v after %v",
+		i+1, strings.Join(step.Command, " "), step.ExitCode, duration)
+}
+
+// exitCode returns the exit code for the error returned from running a command,
+// or -1 if the command did not get to exit by itself
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
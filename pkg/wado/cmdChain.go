@@ -5,31 +5,61 @@ import (
 	"io"
 	"log"
 	"sync"
+	"time"
 )
 
 // CmdChain maintains a chain of commands and runs them in sequence
 type CmdChain interface {
 	SetWriter(io.Writer)
-	Start() error
-	Restart() error
+	SetStepWriters(func(step CmdConfig) (stdout io.Writer, stderr io.Writer))
+	SetEnv([]string)
+	SetInstanceName(string)
+	Start(changedFiles ...string) error
+	Restart(changedFiles ...string) error
 	Kill()
-	Wait()
+	Wait() *ChainResult
+	WaitReady() *ChainResult
+	ReadyWaiter() func() *ChainResult
 	IsRunning() bool
 }
 
 type cmdChain struct {
-	runners    []CmdRunner
-	isRunning  bool
+	instance  string
+	runners   []CmdRunner
+	isRunning bool
+	run       *chainRun
+	result    *ChainResult
+	mutex     *sync.Mutex
+}
+
+// chainRun holds the channels of a single run of the chain, which only that
+// run closes, and its result once it is ready
+type chainRun struct {
 	shouldKill chan bool
+	isReady    chan bool
 	isDone     chan error
-	mutex      *sync.Mutex
+	result     *ChainResult
+}
+
+func (run *chainRun) waitReady() *ChainResult {
+	<-run.isReady
+	return run.result
 }
 
 // NewCmdChain creates a new CmdChain based on the given list of commands
 func NewCmdChain(cmds ...string) (CmdChain, error) {
+	configs := []CmdConfig{}
+	for _, cmd := range cmds {
+		configs = append(configs, CmdConfig{Run: cmd})
+	}
+	return NewCmdChainFromConfigs(configs...)
+}
+
+// NewCmdChainFromConfigs creates a new CmdChain based on the given list of command configurations
+func NewCmdChainFromConfigs(cmds ...CmdConfig) (CmdChain, error) {
 	runners := []CmdRunner{}
 	for _, cmd := range cmds {
-		cmdRunner, err := NewCmdRunner(cmd)
+		cmdRunner, err := NewCmdRunnerFromConfig(cmd)
 		if err != nil {
 			return nil, err
 		}
@@ -39,6 +69,7 @@ func NewCmdChain(cmds ...string) (CmdChain, error) {
 	return &cmdChain{
 		runners:   runners,
 		isRunning: false,
+		result:    &ChainResult{},
 		mutex:     &sync.Mutex{},
 	}, nil
 }
@@ -50,6 +81,31 @@ func (c *cmdChain) SetWriter(writer io.Writer) {
 	}
 }
 
+// SetStepWriters sets separate writers for the stdout and stderr of each command
+// in the chain, as returned by the given function for the configuration of the command
+func (c *cmdChain) SetStepWriters(writers func(step CmdConfig) (io.Writer, io.Writer)) {
+	for _, runner := range c.runners {
+		stdout, stderr := writers(runner.GetConfig())
+		runner.SetWriter(stdout)
+		runner.SetErrWriter(stderr)
+	}
+}
+
+// SetEnv sets extra environment variables, in the form "key=value", for all commands in the chain
+func (c *cmdChain) SetEnv(env []string) {
+	for _, runner := range c.runners {
+		runner.SetEnv(env)
+	}
+}
+
+// SetInstanceName sets the name of the instance the chain belongs to, used in events
+func (c *cmdChain) SetInstanceName(name string) {
+	c.instance = name
+	for _, runner := range c.runners {
+		runner.SetInstanceName(name)
+	}
+}
+
 // IsRunning returns true if the chain is currently running
 func (c *cmdChain) IsRunning() bool {
 	c.mutex.Lock()
@@ -63,21 +119,26 @@ func (c *cmdChain) SetIsRunning(running bool) {
 	c.isRunning = running
 }
 
-// Start starts the command chain
-func (c *cmdChain) Start() error {
-	if c.IsRunning() {
+// Start starts the command chain for the given changed files
+func (c *cmdChain) Start(changedFiles ...string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.isRunning {
 		return errors.New("already running")
 	}
 
-	c.isDone = make(chan error)
-	c.SetIsRunning(true)
-	c.shouldKill = make(chan bool, 50)
-	go c.startChain()
+	c.isRunning = true
+	c.run = &chainRun{
+		shouldKill: make(chan bool, 50),
+		isReady:    make(chan bool),
+		isDone:     make(chan error),
+	}
+	go c.startChain(changedFiles, c.run)
 	return nil
 }
 
-// Restart restarts the command chain
-func (c *cmdChain) Restart() error {
+// Restart restarts the command chain for the given changed files
+func (c *cmdChain) Restart(changedFiles ...string) error {
 	var err error
 	if c.IsRunning() {
 		c.Kill()
@@ -85,61 +146,219 @@ func (c *cmdChain) Restart() error {
 			return err
 		}
 	}
-	return c.Start()
+	return c.Start(changedFiles...)
 }
 
 // Kill kills the currently running command and stops the execution of the following ones
 func (c *cmdChain) Kill() {
-	if c.IsRunning() {
-		if c.shouldKill != nil && len(c.shouldKill) == 0 {
-			c.shouldKill <- true
+	c.mutex.Lock()
+	running, run := c.isRunning, c.run
+	c.mutex.Unlock()
+
+	if running {
+		select {
+		case run.shouldKill <- true:
+		default:
 		}
-		<-c.isDone
+		<-run.isDone
 	}
 }
 
-// Wait waits until all the commands in the chain have finished executing
-func (c *cmdChain) Wait() {
-	if c.IsRunning() {
-		<-c.isDone
+// Wait waits until all the commands in the chain have finished executing,
+// and returns the result of the latest run of the chain
+func (c *cmdChain) Wait() *ChainResult {
+	c.mutex.Lock()
+	running, run := c.isRunning, c.run
+	c.mutex.Unlock()
+
+	if running {
+		<-run.isDone
 	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.result
 }
 
-// Main method for executing the chain of commands
-func (c *cmdChain) startChain() {
-	var err error
-	wasKilled := false
-	for _, runner := range c.runners {
-		if wasKilled {
-			break
-		}
+// WaitReady waits until all the commands in the chain have finished executing,
+// or in the case of services have become ready, and returns the result
+func (c *cmdChain) WaitReady() *ChainResult {
+	c.mutex.Lock()
+	running, run := c.isRunning, c.run
+	c.mutex.Unlock()
+
+	if running {
+		<-run.isReady
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.result
+}
+
+// ReadyWaiter returns a function that waits like WaitReady, but for the run
+// that is current now, and returns the result of that run even if the chain
+// has been restarted in the meantime
+func (c *cmdChain) ReadyWaiter() func() *ChainResult {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.run == nil {
+		result := c.result
+		return func() *ChainResult { return result }
+	}
+	return c.run.waitReady
+}
+
+func (c *cmdChain) setResult(result *ChainResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.result = result
+}
+
+// Main method for executing the chain of commands. The chain stops at the first
+// failing command, unless it is set to continue on errors or allow failures.
+// Services that have become ready keep running until the chain is killed.
+func (c *cmdChain) startChain(changedFiles []string, run *chainRun) {
+	result := &ChainResult{}
+	chainStart := time.Now()
+	services := []CmdRunner{}
+	emitEvent(Event{Type: EventChainStarted, Instance: c.instance, Files: changedFiles})
+
+	for i, runner := range c.runners {
+		config := runner.GetConfig()
+		stepStart := time.Now()
 
-		err = runner.Start()
+		err := runner.Start(changedFiles...)
+		emitEvent(Event{Type: EventStepStarted, Instance: c.instance, Step: intPtr(i), Command: runner.GetCommand()})
 		if err != nil {
 			log.Printf("Error: could not run the command (%v): %v\n", runner.GetCommand(), err)
-		}
+		} else {
+			// Tasks have to finish, while services only have to become ready
+			done := make(chan error, 1)
+			go func() {
+				if config.IsService() {
+					done <- runner.WaitReady()
+				} else {
+					done <- runner.Wait()
+				}
+			}()
 
-		done := make(chan error)
-		go func() {
-			done <- runner.Wait()
-		}()
+			select {
+			case <-run.shouldKill:
+				killRunner(runner)
+				result.Killed = true
+			case err = <-done:
+				if err != nil && !config.AllowFailure {
+					log.Printf("Error: command failed (%v): %v\n", runner.GetCommand(), err)
+				}
+			}
 
-		select {
-		case <-c.shouldKill:
-			err = runner.Kill()
-			if err != nil {
-				log.Printf("Error: waiting on command failed (%v): %v\n", runner.GetCommand(), err)
+			if config.IsService() && !result.Killed {
+				if err == nil {
+					services = append(services, runner)
+				} else {
+					killRunner(runner)
+				}
 			}
-			wasKilled = true
+		}
+
+		step := StepResult{
+			Command:  runner.GetCommand(),
+			ExitCode: exitCode(err),
+			Err:      err,
+			Failed:   err != nil && !config.AllowFailure && !result.Killed,
+			Duration: time.Since(stepStart),
+		}
+		result.Steps = append(result.Steps, step)
+		emitEvent(stepFinishedEvent(c.instance, i, step, result.Killed))
+
+		if result.Killed || (step.Failed && !config.ContinueOnError) {
 			break
-		case err := <-done:
-			if err != nil {
-				log.Printf("Error: waiting on command failed (%v): %v\n", runner.GetCommand(), err)
-			}
 		}
 	}
 
-	c.SetIsRunning(false)
-	close(c.shouldKill)
-	close(c.isDone)
+	result.Duration = time.Since(chainStart)
+	if !result.Killed && len(c.runners) > 0 {
+		log.Println(result)
+	}
+	emitEvent(Event{
+		Type:     EventChainFinished,
+		Instance: c.instance,
+		Success:  boolPtr(result.Success()),
+		Killed:   result.Killed,
+		Duration: durationMs(result.Duration),
+	})
+
+	c.setResult(result)
+	run.result = result
+	close(run.isReady)
+
+	if !result.Killed && len(services) > 0 {
+		waitForServices(services, run.shouldKill)
+	}
+
+	// Stop the services in the opposite order of how they were started
+	for i := len(services) - 1; i >= 0; i-- {
+		killRunner(services[i])
+	}
+
+	// The run is done as a whole, so a restart waiting for it can start the next one
+	c.mutex.Lock()
+	c.isRunning = false
+	close(run.isDone)
+	c.mutex.Unlock()
+}
+
+// waitForServices blocks until all the services have exited or the chain is killed
+func waitForServices(services []CmdRunner, shouldKill chan bool) {
+	allExited := make(chan bool)
+	killed := make(chan bool)
+	wg := sync.WaitGroup{}
+	for _, service := range services {
+		wg.Add(1)
+		go func(service CmdRunner) {
+			err := service.Wait()
+			select {
+			case <-killed:
+			default:
+				log.Printf("Service exited (%v): %v\n", service.GetCommand(), err)
+			}
+			wg.Done()
+		}(service)
+	}
+	go func() {
+		wg.Wait()
+		close(allExited)
+	}()
+
+	select {
+	case <-shouldKill:
+		close(killed)
+	case <-allExited:
+	}
+}
+
+func stepFinishedEvent(instance string, i int, step StepResult, killed bool) Event {
+	event := Event{
+		Type:     EventStepFinished,
+		Instance: instance,
+		Step:     intPtr(i),
+		Command:  step.Command,
+		ExitCode: intPtr(step.ExitCode),
+		Success:  boolPtr(!step.Failed && !killed),
+		Killed:   killed,
+		Duration: durationMs(step.Duration),
+	}
+	if step.Err != nil {
+		event.Error = step.Err.Error()
+	}
+	return event
+}
+
+func killRunner(runner CmdRunner) {
+	err := runner.Kill()
+	if err != nil {
+		log.Printf("Error: killing command failed (%v): %v\n", runner.GetCommand(), err)
+	}
 }
@@ -1,7 +1,11 @@
 package wado
 
 import (
+	"io"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mktange/wado/internal/pkg/syncimpls"
 	"github.com/mktange/wado/internal/pkg/util"
@@ -44,3 +48,169 @@ func Test_CmdChainKill(t *testing.T) {
 	assert.Contains(t, buffer.String(), "Counter")
 	assert.NotContains(t, buffer.String(), "After")
 }
+
+func Test_CmdChainConcurrentRestarts(t *testing.T) {
+	chain, err := NewCmdChain("sleep 0.01", "echo Foo")
+	require.NoError(t, err)
+
+	// Restarting from several goroutines at once must not mix up the runs
+	done := make(chan bool)
+	for i := 0; i < 5; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				chain.Restart()
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+
+	chain.Wait()
+	assert.False(t, chain.IsRunning())
+}
+
+func Test_CmdChainReadyWaiter(t *testing.T) {
+	chain, err := NewCmdChain("sleep 10")
+	require.NoError(t, err)
+
+	chain.Start()
+	waitReady := chain.ReadyWaiter()
+
+	// The waiter keeps to its own run, which was killed by the restart
+	chain.Restart()
+	assert.True(t, waitReady().Killed)
+
+	waitReady = chain.ReadyWaiter()
+	chain.Kill()
+	assert.True(t, waitReady().Killed)
+}
+
+func Test_CmdChainFailFast(t *testing.T) {
+	chain, err := NewCmdChain("echo Before", "sh -c 'exit 3'", "echo After")
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	chain.SetWriter(buffer)
+
+	chain.Start()
+	result := chain.Wait()
+
+	assert.Equal(t, "Before\n", buffer.String())
+	assert.False(t, result.Success())
+	assert.Len(t, result.Steps, 2)
+	assert.Equal(t, 1, result.FailedStepIndex())
+	assert.Equal(t, 3, result.FailedStep().ExitCode)
+	assert.Contains(t, result.String(), "failed at step 2 (sh -c exit 3) with exit code 3")
+}
+
+func Test_CmdChainContinueOnError(t *testing.T) {
+	chain, err := NewCmdChainFromConfigs(
+		CmdConfig{Run: "sh -c 'exit 1'", ContinueOnError: true},
+		CmdConfig{Run: "sh -c 'exit 2'", AllowFailure: true},
+		CmdConfig{Run: "echo After"},
+	)
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	chain.SetWriter(buffer)
+
+	chain.Start()
+	result := chain.Wait()
+
+	assert.Equal(t, "After\n", buffer.String())
+	assert.Len(t, result.Steps, 3)
+	assert.Equal(t, 0, result.FailedStepIndex())
+	assert.False(t, result.Steps[1].Failed)
+	assert.Equal(t, 2, result.Steps[1].ExitCode)
+	assert.False(t, result.Success())
+}
+
+func Test_CmdChainServiceReadyLog(t *testing.T) {
+	chain, err := NewCmdChainFromConfigs(
+		CmdConfig{
+			Run:   util.GetCounterRunCmd(),
+			Kind:  KindService,
+			Ready: &ReadyConfig{Log: "^Counter: 3$"},
+		},
+		CmdConfig{Run: "echo After"},
+	)
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	chain.SetWriter(buffer)
+
+	chain.Start()
+	result := chain.WaitReady()
+
+	assert.True(t, result.Success())
+	assert.True(t, chain.IsRunning(), "Service should keep running")
+	assert.Contains(t, buffer.String(), "Counter: 3\n")
+	assert.Contains(t, buffer.String(), "After\n")
+	assert.True(t, strings.Index(buffer.String(), "Counter: 3") < strings.Index(buffer.String(), "After"))
+
+	chain.Kill()
+	assert.False(t, chain.IsRunning())
+}
+
+func Test_CmdChainServiceReadyLogStderr(t *testing.T) {
+	chain, err := NewCmdChainFromConfigs(
+		CmdConfig{
+			Run:   "echo starting; echo listening >&2; sleep 10",
+			Shell: true,
+			Kind:  KindService,
+			Ready: &ReadyConfig{Log: "^listening$", Timeout: 2 * time.Second},
+		},
+	)
+	require.NoError(t, err)
+	defer chain.Kill()
+
+	stdout := syncimpls.NewSyncBuffer()
+	stderr := syncimpls.NewSyncBuffer()
+	chain.SetStepWriters(func(CmdConfig) (io.Writer, io.Writer) {
+		return stdout, stderr
+	})
+
+	chain.Start()
+	assert.True(t, chain.WaitReady().Success())
+	assert.Equal(t, "starting\n", stdout.String())
+	assert.Equal(t, "listening\n", stderr.String())
+}
+
+func Test_CmdChainServiceReadyTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	chain, err := NewCmdChainFromConfigs(
+		CmdConfig{
+			Run:   util.GetCounterRunCmd(),
+			Kind:  KindService,
+			Ready: &ReadyConfig{TCP: address, Timeout: 300 * time.Millisecond},
+		},
+		CmdConfig{Run: "echo After"},
+	)
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	chain.SetWriter(buffer)
+
+	// Nothing is listening, so the service never becomes ready
+	chain.Start()
+	result := chain.Wait()
+	assert.Equal(t, 0, result.FailedStepIndex())
+	assert.EqualError(t, result.Steps[0].Err, "not ready after 300ms")
+	assert.NotContains(t, buffer.String(), "After")
+
+	listener, err = net.Listen("tcp", address)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	chain.Start()
+	result = chain.WaitReady()
+	assert.True(t, result.Success())
+	assert.True(t, chain.IsRunning(), "Service should keep running")
+	chain.Kill()
+}
@@ -2,12 +2,16 @@ package wado
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,38 +19,202 @@ import (
 	"github.com/mktange/wado/internal/pkg/util"
 )
 
+// How long to keep copying output after a command has exited
+const outputWaitDelay = 500 * time.Millisecond
+
 // CmdRunner can maintain and run a chain of commands
 type CmdRunner interface {
-	Restart() error
-	Start() error
+	Restart(changedFiles ...string) error
+	Start(changedFiles ...string) error
 	Kill() error
 	SetWriter(writer io.Writer)
+	SetErrWriter(writer io.Writer)
+	SetEnv(env []string)
+	SetInstanceName(name string)
 	Wait() error
+	WaitReady() error
+	GetConfig() CmdConfig
 	GetProcess() *os.Process
 	GetCommand() []string
 }
 
-type cmdDef struct {
-	bin  string
-	args []string
+// CmdConfig holds the configuration of a single command. In the config file it
+// can either be given as just the command string, or as an object with the settings.
+type CmdConfig struct {
+	Name    string            `yaml:"name,omitempty"`
+	Run     string            `yaml:"run"`
+	Dir     string            `yaml:"dir,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Shell   bool              `yaml:"shell,omitempty"`
+	Timeout time.Duration     `yaml:"timeout,omitempty"`
+
+	// Kind is either a task (the default) or a service, which is considered
+	// done once the ready probes pass
+	Kind  string       `yaml:"kind,omitempty"`
+	Ready *ReadyConfig `yaml:"ready,omitempty"`
+
+	// Stop holds how the command is stopped when the chain is killed or restarted
+	Stop *StopConfig `yaml:"stop,omitempty"`
+
+	// AllowFailure treats the command failing as a success, while ContinueOnError
+	// reports the failure but still runs the rest of the chain
+	AllowFailure    bool `yaml:"allowFailure,omitempty"`
+	ContinueOnError bool `yaml:"continueOnError,omitempty"`
+}
+
+// StepName returns the name of the command, which defaults to the program it runs
+func (c CmdConfig) StepName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	fields := strings.Fields(c.Run)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.Trim(filepath.Base(fields[0]), `"'`)
+}
+
+// StopConfig holds the signals to stop a command with, tried in order with the
+// timeout as grace period for each, before the command is killed for real.
+// Signal is the short form of giving a single signal.
+type StopConfig struct {
+	Signal  string        `yaml:"signal,omitempty"`
+	Signals []string      `yaml:"signals,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// Defaults for stopping commands, used for the fields left empty in StopConfig
+const (
+	DefaultStopSignal  = "SIGINT"
+	DefaultStopTimeout = 2 * time.Second
+)
+
+// UnmarshalYAML reads a timeout given as a plain number as milliseconds
+func (c *StopConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainStopConfig StopConfig
+	if err := unmarshal((*plainStopConfig)(c)); err != nil {
+		return err
+	}
+	return unmarshalMilliseconds(unmarshal, map[string]*time.Duration{"timeout": &c.Timeout})
+}
+
+func (c *StopConfig) parse() ([]os.Signal, time.Duration, error) {
+	names := []string{}
+	timeout := DefaultStopTimeout
+	if c != nil {
+		if c.Signal != "" {
+			names = append(names, c.Signal)
+		}
+		names = append(names, c.Signals...)
+		if c.Timeout > 0 {
+			timeout = c.Timeout
+		}
+	}
+	if len(names) == 0 {
+		names = []string{DefaultStopSignal}
+	}
+
+	signals := []os.Signal{}
+	for _, name := range names {
+		signal, err := util.ParseSignal(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		signals = append(signals, signal)
+	}
+	return signals, timeout, nil
+}
+
+// UnmarshalYAML allows a command to be given as a plain string
+func (c *CmdConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var run string
+	if err := unmarshal(&run); err == nil {
+		*c = CmdConfig{Run: run}
+		return nil
+	}
+
+	// Unmarshal into another type to not end up back here
+	type plainCmdConfig CmdConfig
+	if err := unmarshal((*plainCmdConfig)(c)); err != nil {
+		return err
+	}
+	return unmarshalMilliseconds(unmarshal, map[string]*time.Duration{"timeout": &c.Timeout})
 }
 
 type cmdRun struct {
-	bin    string
-	args   []string
-	cmd    *exec.Cmd
-	writer io.Writer
-	done   chan error
-	mutex  *sync.Mutex
+	instance string
+	bin      string
+	args     []string
+	template string
+	config   CmdConfig
+	env      []string
+	cmd      *exec.Cmd
+
+	stopSignals []os.Signal
+	stopTimeout time.Duration
+
+	writer    io.Writer
+	errWriter io.Writer
+	err       error
+	done      chan error
+
+	// Closed when a line of the output matches the ready log probe of a service
+	logMatched chan bool
+	mutex      *sync.Mutex
 }
 
-// NewCmdRunner creates a new runner for a full command string
+// NewCmdRunner creates a new runner for a full command string. The command may
+// contain placeholders for the changed files, e.g. {{.File}}, {{.Files}} and {{.Dir}}.
 func NewCmdRunner(cmd string) (CmdRunner, error) {
-	words, err := shellwords.Parse(cmd)
+	return NewCmdRunnerFromConfig(CmdConfig{Run: cmd})
+}
+
+// NewCmdRunnerFromConfig creates a new runner for the given command configuration
+func NewCmdRunnerFromConfig(config CmdConfig) (CmdRunner, error) {
+	if err := config.validateKind(); err != nil {
+		return nil, err
+	}
+	stopSignals, stopTimeout, err := config.Stop.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	// Fill in the placeholders as for the initial run, to get the words to show
+	// and make sure the command parses
+	bin, args, err := parseCmd(expandCmd(config.Run, nil, config.Shell), config.Shell)
 	if err != nil {
 		return nil, err
 	}
-	return NewCmdRunnerBinArgs(words[0], words[1:]...), nil
+
+	runner := NewCmdRunnerBinArgs(bin, args...).(*cmdRun)
+	runner.config = config
+	runner.stopSignals = stopSignals
+	runner.stopTimeout = stopTimeout
+	if hasPlaceholders(config.Run) {
+		runner.template = config.Run
+	}
+	return runner, nil
+}
+
+// parseCmd splits the command into the binary and its arguments. Shell commands
+// are passed on as a whole to the shell of the OS.
+func parseCmd(cmd string, shell bool) (string, []string, error) {
+	if strings.TrimSpace(cmd) == "" {
+		return "", nil, errors.New("empty command")
+	}
+	if shell {
+		bin, args := util.ShellCommand(cmd)
+		return bin, args, nil
+	}
+
+	words, err := shellwords.Parse(cmd)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(words) == 0 {
+		return "", nil, errors.New("empty command")
+	}
+	return words[0], words[1:], nil
 }
 
 // NewCmdRunnerBinArgs creates a new runner for a command from a binary path and arguments
@@ -54,8 +222,12 @@ func NewCmdRunnerBinArgs(bin string, args ...string) CmdRunner {
 	return &cmdRun{
 		bin:    bin,
 		args:   args,
+		config: CmdConfig{Run: strings.Join(append([]string{bin}, args...), " ")},
 		writer: ioutil.Discard,
 		mutex:  &sync.Mutex{},
+
+		stopSignals: []os.Signal{os.Interrupt},
+		stopTimeout: DefaultStopTimeout,
 	}
 }
 
@@ -64,7 +236,9 @@ func (r *cmdRun) GetCommand() []string {
 }
 
 func (r *cmdRun) GetProcess() *os.Process {
-	if r.isCmdSet() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.cmd != nil {
 		return r.cmd.Process
 	}
 	return nil
@@ -94,102 +268,297 @@ func (r *cmdRun) closeDone() {
 	close(r.done)
 }
 
-func (r *cmdRun) Restart() error {
+func (r *cmdRun) setErr(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.err = err
+}
+
+func (r *cmdRun) getErr() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *cmdRun) Restart(changedFiles ...string) error {
 	if r.isCmdSet() {
 		err := r.Kill()
 		if err != nil {
 			return err
 		}
 	}
-	return r.Start()
+	return r.Start(changedFiles...)
 }
 
+// SetWriter sets the writer for the output of the command, including stderr
+// unless it has its own writer
 func (r *cmdRun) SetWriter(writer io.Writer) {
 	r.writer = writer
 }
 
+// SetErrWriter sets a separate writer for the stderr output of the command
+func (r *cmdRun) SetErrWriter(writer io.Writer) {
+	r.errWriter = writer
+}
+
+// SetEnv sets extra environment variables, in the form "key=value", for the command
+func (r *cmdRun) SetEnv(env []string) {
+	r.env = env
+}
+
+// SetInstanceName sets the name of the instance the command belongs to, used in events
+func (r *cmdRun) SetInstanceName(name string) {
+	r.instance = name
+}
+
+// Wait waits for the command to finish, and returns the error it finished with
 func (r *cmdRun) Wait() error {
-	if !r.isCmdSet() {
-		return nil
+	r.mutex.Lock()
+	running, done := r.cmd != nil, r.done
+	r.mutex.Unlock()
+
+	if running {
+		<-done
 	}
-	err := <-r.done
-	return err
+	return r.getErr()
 }
 
-func (r *cmdRun) Start() error {
+func (r *cmdRun) Start(changedFiles ...string) error {
 	if r.isCmdSet() {
 		return errors.New("already running")
 	}
 
-	r.setCmd(exec.Command(r.bin, r.args...))
-	r.makeDone()
-	util.SetupCmd(r.cmd)
+	bin, args := r.bin, r.args
+	if r.template != "" {
+		var err error
+		bin, args, err = parseCmd(expandCmd(r.template, changedFiles, r.config.Shell), r.config.Shell)
+		if err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command(bin, args...)
+	cmd.Dir = r.config.Dir
+	cmd.Env = append(append(os.Environ(), r.env...), changedFilesEnv(changedFiles)...)
+	for key, value := range r.config.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	util.SetupCmd(cmd)
 
-	// Pipe stdout and stderr to writer
-	stdout, err := r.cmd.StdoutPipe()
+	// Output is copied to the writer until the command finishes, and a little
+	// while longer for any children holding on to it
+	writer, errWriter := r.writer, r.errWriter
+	var logMatched chan bool
+	if r.config.Ready != nil && r.config.Ready.Log != "" {
+		matchWriter := newLineMatchWriter(writer, regexp.MustCompile(r.config.Ready.Log))
+		writer = matchWriter
+		if errWriter != nil {
+			errWriter = matchWriter.withWriter(errWriter)
+		}
+		logMatched = matchWriter.matched
+	}
+	if errWriter == nil {
+		errWriter = writer
+	}
+	stdout, err := newOutputCopy(writer)
 	if err != nil {
 		return err
 	}
-	stderr, err := r.cmd.StderrPipe()
+	stderr, err := newOutputCopy(errWriter)
 	if err != nil {
+		stdout.close()
 		return err
 	}
+	cmd.Stdout = stdout.pipe
+	cmd.Stderr = stderr.pipe
 
-	go io.Copy(r.writer, stdout)
-	go io.Copy(r.writer, stderr)
+	r.setErr(nil)
+	r.setCmd(cmd)
+	r.makeDone()
+	r.mutex.Lock()
+	r.logMatched = logMatched
+	r.mutex.Unlock()
 
 	// Start cmd
 	err = r.cmd.Start()
+	stdout.pipe.Close()
+	stderr.pipe.Close()
 	if err != nil {
+		stdout.close()
+		stderr.close()
+		r.setCmd(nil)
+		r.setErr(err)
+		r.closeDone()
 		return err
 	}
 
+	var timeout *time.Timer
+	timedOut := make(chan bool, 1)
+	if r.config.Timeout > 0 {
+		timeout = time.AfterFunc(r.config.Timeout, func() {
+			timedOut <- true
+			r.Kill()
+		})
+	}
+
 	go func() {
-		r.cmd.Wait()
+		err := cmd.Wait()
+		if timeout != nil {
+			timeout.Stop()
+		}
+		outputDeadline := time.Now().Add(outputWaitDelay)
+		stdout.finish(outputDeadline)
+		stderr.finish(outputDeadline)
+		select {
+		case <-timedOut:
+			err = fmt.Errorf("timed out after %v", r.config.Timeout)
+		default:
+		}
+
+		r.setErr(err)
 		r.setCmd(nil)
 		r.closeDone()
 	}()
 	return nil
 }
 
+// outputCopy copies the output written to a pipe to a writer. The command gets
+// the write end of the pipe directly, so waiting for it to exit does not wait
+// for any children it left behind holding on to the pipe.
+type outputCopy struct {
+	pipe   *os.File
+	reader *os.File
+	done   chan bool
+}
+
+func newOutputCopy(writer io.Writer) (*outputCopy, error) {
+	reader, pipe, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	c := &outputCopy{pipe: pipe, reader: reader, done: make(chan bool)}
+	go func() {
+		io.Copy(writer, reader)
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// finish waits for the rest of the output to be copied, until the deadline
+func (c *outputCopy) finish(deadline time.Time) {
+	select {
+	case <-c.done:
+	case <-time.After(time.Until(deadline)):
+	}
+	c.reader.Close()
+}
+
+func (c *outputCopy) close() {
+	c.pipe.Close()
+	c.reader.Close()
+}
+
+// GetConfig returns the configuration the runner was created with
+func (r *cmdRun) GetConfig() CmdConfig {
+	return r.config
+}
+
+// How long to wait for a process and the rest of its group to go away after they have been killed
+const groupKillTimeout = time.Second
+
+// Kill stops the command by sending its process group the stop signals in order,
+// each given the grace period to stop in, and finally kills the group for real
+// if anything in it is still running
 func (r *cmdRun) Kill() error {
-	if r.GetProcess() != nil {
+	process := r.GetProcess()
+	if process == nil {
+		return nil
+	}
 
-		if runtime.GOOS == "windows" {
-			// Kill immediatly on windows
-			err := util.HardKill(r.cmd.Process.Pid)
-			if err != nil {
-				return err
-			}
+	r.mutex.Lock()
+	done := r.done
+	r.mutex.Unlock()
 
-		} else {
+	event := Event{
+		Type:     EventProcessKilled,
+		Instance: r.instance,
+		Command:  r.GetCommand(),
+		Pid:      process.Pid,
+	}
 
-			// Try to stop it with an interrupt on unix
-			if err := r.cmd.Process.Signal(os.Interrupt); err != nil {
-				return err
-			}
+	if runtime.GOOS == "windows" {
+		// Kill immediatly on windows
+		err := util.HardKill(process.Pid)
+		if err != nil {
+			return err
+		}
+		event.Signal = "SIGKILL"
 
-			// Wait for the process to finish, or kill after 3 seconds
+	} else if signal, stopped := r.stopWithSignals(process.Pid, done); !stopped {
+		if err := util.HardKill(process.Pid); err != nil {
+			log.Println("Failed to kill process:", err)
+		}
+		event.Signal = "SIGKILL"
+		event.Escalated = true
+	} else {
+		event.Signal = util.SignalName(signal)
+	}
+	emitEvent(event)
+
+	// Wait for process to actually stop, which it may never do if killing it failed
+	select {
+	case <-done:
+	case <-time.After(groupKillTimeout):
+		return fmt.Errorf("process %v is still running after being killed", process.Pid)
+	}
+
+	// Make sure nothing started by the command is left behind
+	if !waitForGroupStopped(process.Pid, nil, groupKillTimeout) {
+		log.Printf("Processes in group %v are still running after being killed (%v)\n", process.Pid, r.GetCommand())
+	}
+	return nil
+}
+
+// stopWithSignals goes through the stop signals, and returns the signal the
+// process group stopped on, and whether it stopped at all
+func (r *cmdRun) stopWithSignals(pid int, done chan error) (os.Signal, bool) {
+	for _, signal := range r.stopSignals {
+		if err := util.SignalGroup(pid, signal); err != nil {
+			log.Printf("Failed to send %v to process group: %v\n", signal, err)
+			return nil, false
+		}
+
+		if waitForGroupStopped(pid, done, r.stopTimeout) {
+			return signal, true
+		}
+		log.Printf("Command did not stop on %v within %v (%v)\n", signal, r.stopTimeout, r.GetCommand())
+	}
+	return nil, false
+}
+
+// waitForGroupStopped waits for the process to be done, if a done channel is
+// given, and for the rest of its group to stop. Returns false on timeout.
+func waitForGroupStopped(pid int, done chan error, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		if done != nil {
 			select {
-			case <-time.After(2 * time.Second):
-				if err := r.cmd.Process.Kill(); err != nil {
-					log.Println("Failed to kill process:", err)
-				}
-			case <-r.done:
+			case <-done:
+				done = nil
+			case <-deadline:
+				return false
 			}
+			continue
 		}
 
-		// Wait for process to actually stop
-		for {
-			if r.GetProcess() == nil {
-				break
-			}
-			if !util.IsProcessRunning(r.cmd.Process.Pid) {
-				break
-			}
-			<-time.After(10 * time.Millisecond)
+		if !util.IsProcessGroupRunning(pid) {
+			return true
 		}
-	}
 
-	return nil
+		select {
+		case <-deadline:
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
 }
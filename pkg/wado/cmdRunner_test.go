@@ -1,6 +1,9 @@
 package wado
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -9,6 +12,7 @@ import (
 	"github.com/mktange/wado/internal/pkg/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
 )
 
 func getCounterRunner(counterArgs ...string) (CmdRunner, error) {
@@ -99,3 +103,252 @@ func Test_ManyRestarts(t *testing.T) {
 	}
 
 }
+
+func Test_ChangedFilesPlaceholders(t *testing.T) {
+	runner, err := NewCmdRunner("echo {{.Files}} in {{.Dir}}")
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	runner.SetWriter(buffer)
+
+	err = runner.Start("a.go", "sub dir/b.go")
+	require.NoError(t, err)
+	err = runner.Wait()
+	require.NoError(t, err)
+
+	assert.Equal(t, "a.go sub dir/b.go in sub dir\n", buffer.String())
+}
+
+func Test_ChangedFilesPlaceholdersShell(t *testing.T) {
+	runner, err := NewCmdRunnerFromConfig(CmdConfig{Run: "echo {{.File}} | tr a-z A-Z", Shell: true})
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	runner.SetWriter(buffer)
+
+	err = runner.Start("it's a.go")
+	require.NoError(t, err)
+	err = runner.Wait()
+	require.NoError(t, err)
+
+	assert.Equal(t, "IT'S A.GO\n", buffer.String())
+}
+
+func Test_OtherBracesLeftAlone(t *testing.T) {
+	runner, err := NewCmdRunner("echo '{{.State}}' {{ .File }}")
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	runner.SetWriter(buffer)
+
+	err = runner.Start("a.go")
+	require.NoError(t, err)
+	err = runner.Wait()
+	require.NoError(t, err)
+
+	assert.Equal(t, "{{.State}} a.go\n", buffer.String())
+}
+
+func Test_ChangedFilesEnv(t *testing.T) {
+	runner, err := NewCmdRunner(`sh -c 'echo "$WADO_INSTANCE $WADO_CHANGED_FILE"'`)
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	runner.SetWriter(buffer)
+	runner.SetEnv([]string{EnvInstance + "=Test"})
+
+	err = runner.Start("a.go", "b.go")
+	require.NoError(t, err)
+	err = runner.Wait()
+	require.NoError(t, err)
+
+	assert.Equal(t, "Test b.go\n", buffer.String())
+}
+
+func Test_CmdConfigYaml(t *testing.T) {
+	var cmds []CmdConfig
+	err := yaml.Unmarshal([]byte(`
+- go build
+- run: go test ./...
+  dir: sub
+  env:
+    CGO_ENABLED: "0"
+  shell: true
+  timeout: 10s
+  allowFailure: true
+- run: go vet
+  timeout: 10
+`), &cmds)
+	require.NoError(t, err)
+
+	assert.Equal(t, []CmdConfig{
+		{Run: "go build"},
+		{
+			Run:          "go test ./...",
+			Dir:          "sub",
+			Env:          map[string]string{"CGO_ENABLED": "0"},
+			Shell:        true,
+			Timeout:      10 * time.Second,
+			AllowFailure: true,
+		},
+		{Run: "go vet", Timeout: 10 * time.Millisecond},
+	}, cmds)
+}
+
+func Test_CmdConfigDirEnvShell(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	runner, err := NewCmdRunnerFromConfig(CmdConfig{
+		Run:   "echo $FOO > foo.txt && cat foo.txt",
+		Dir:   tmpDir,
+		Env:   map[string]string{"FOO": "Bar"},
+		Shell: true,
+	})
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	runner.SetWriter(buffer)
+
+	err = runner.Start()
+	require.NoError(t, err)
+	err = runner.Wait()
+	require.NoError(t, err)
+
+	assert.Equal(t, "Bar\n", buffer.String())
+	assert.FileExists(t, filepath.Join(tmpDir, "foo.txt"))
+}
+
+func Test_WaitWithChildHoldingOutput(t *testing.T) {
+	runner, err := NewCmdRunnerFromConfig(CmdConfig{
+		Run:   "echo Foo; sleep 2 &",
+		Shell: true,
+	})
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	runner.SetWriter(buffer)
+
+	start := time.Now()
+	err = runner.Start()
+	require.NoError(t, err)
+	err = runner.Wait()
+	require.NoError(t, err)
+
+	assert.Equal(t, "Foo\n", buffer.String())
+	assert.True(t, time.Since(start) < time.Second, "Waiting should not wait for the child holding on to the output")
+}
+
+func Test_CmdConfigTimeout(t *testing.T) {
+	runner, err := NewCmdRunnerFromConfig(CmdConfig{
+		Run:     util.GetCounterRunCmd(),
+		Timeout: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	err = runner.Start()
+	require.NoError(t, err)
+	err = runner.Wait()
+	assert.EqualError(t, err, "timed out after 50ms")
+	assert.Nil(t, runner.GetProcess())
+}
+
+func Test_KillStopSignals(t *testing.T) {
+	runner, err := NewCmdRunnerFromConfig(CmdConfig{
+		Run:   `trap '' INT; trap 'echo Got TERM; exit 0' TERM; while true; do sleep 0.01; done`,
+		Shell: true,
+		Stop: &StopConfig{
+			Signals: []string{"SIGINT", "TERM"},
+			Timeout: 100 * time.Millisecond,
+		},
+	})
+	require.NoError(t, err)
+
+	buffer := syncimpls.NewSyncBuffer()
+	runner.SetWriter(buffer)
+
+	err = runner.Start()
+	require.NoError(t, err)
+	<-time.After(50 * time.Millisecond)
+
+	start := time.Now()
+	err = runner.Kill()
+	require.NoError(t, err)
+
+	assert.Nil(t, runner.GetProcess())
+	// The sleep running in the loop gets TERM too, which the shell may report
+	// with "Terminated" before running the trap
+	assert.Contains(t, buffer.String(), "Got TERM\n")
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "SIGINT should have been given its grace period")
+}
+
+func Test_StopConfigUnknownSignal(t *testing.T) {
+	_, err := NewCmdRunnerFromConfig(CmdConfig{
+		Run:  "echo Foo",
+		Stop: &StopConfig{Signal: "SIGFOO"},
+	})
+	assert.EqualError(t, err, "unknown signal: SIGFOO")
+}
+
+func Test_StopConfigYaml(t *testing.T) {
+	var config CmdConfig
+	require.NoError(t, yaml.Unmarshal([]byte("{run: server, stop: {signal: SIGTERM, timeout: 10000}}"), &config))
+	assert.Equal(t, &StopConfig{Signal: "SIGTERM", Timeout: 10 * time.Second}, config.Stop)
+
+	var other CmdConfig
+	require.NoError(t, yaml.Unmarshal([]byte("{run: server, stop: {timeout: 1m}}"), &other))
+	assert.Equal(t, &StopConfig{Timeout: time.Minute}, other.Stop)
+}
+
+func Test_ReadyConfigYaml(t *testing.T) {
+	var config CmdConfig
+	require.NoError(t, yaml.Unmarshal([]byte("{run: server, kind: service, ready: {tcp: ':8080', timeout: 5000}}"), &config))
+	assert.Equal(t, &ReadyConfig{TCP: ":8080", Timeout: 5 * time.Second}, config.Ready)
+
+	var other CmdConfig
+	require.NoError(t, yaml.Unmarshal([]byte("{run: server, kind: service, ready: {log: listening, timeout: 30s}}"), &other))
+	assert.Equal(t, &ReadyConfig{Log: "listening", Timeout: 30 * time.Second}, other.Ready)
+}
+
+func Test_KillProcessGroup(t *testing.T) {
+	// Background jobs ignore SIGINT, so the group has to be killed for real
+	runner, err := NewCmdRunnerFromConfig(CmdConfig{
+		Run:   "sleep 10 & sleep 10",
+		Shell: true,
+		Stop:  &StopConfig{Timeout: 100 * time.Millisecond},
+	})
+	require.NoError(t, err)
+
+	err = runner.Start()
+	require.NoError(t, err)
+	pid := runner.GetProcess().Pid
+	<-time.After(50 * time.Millisecond)
+
+	err = runner.Kill()
+	require.NoError(t, err)
+
+	assert.Nil(t, runner.GetProcess())
+	assert.False(t, util.IsProcessGroupRunning(pid), "Processes in the group should have been killed")
+}
+
+func Test_StepName(t *testing.T) {
+	assert.Equal(t, "go", CmdConfig{Run: "go build ./..."}.StepName())
+	assert.Equal(t, "server", CmdConfig{Run: "./bin/server -port 8080"}.StepName())
+	assert.Equal(t, "api", CmdConfig{Name: "api", Run: "go run ."}.StepName())
+	assert.Equal(t, "", CmdConfig{}.StepName())
+}
+
+func Test_CmdRunnerErrWriter(t *testing.T) {
+	stdout := syncimpls.NewSyncBuffer()
+	stderr := syncimpls.NewSyncBuffer()
+	runner, err := NewCmdRunnerFromConfig(CmdConfig{Run: "echo out; echo err >&2", Shell: true})
+	require.NoError(t, err)
+	runner.SetWriter(stdout)
+	runner.SetErrWriter(stderr)
+
+	require.NoError(t, runner.Start())
+	require.NoError(t, runner.Wait())
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+}
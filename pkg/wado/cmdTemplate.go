@@ -0,0 +1,88 @@
+package wado
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mktange/wado/internal/pkg/util"
+)
+
+// Environment variables describing the changes that triggered a command
+const (
+	EnvChangedFiles = "WADO_CHANGED_FILES"
+	EnvChangedFile  = "WADO_CHANGED_FILE"
+	EnvInstance     = "WADO_INSTANCE"
+)
+
+// cmdTemplateData is what the placeholders in commands are filled with, e.g. {{.Files}}.
+// Paths are quoted so they survive being split into words.
+type cmdTemplateData struct {
+	File  string
+	Files string
+	Dir   string
+}
+
+// placeholderRegex matches the placeholders of cmdTemplateData. Anything else in
+// braces is left alone, so commands can still contain e.g. --format '{{.State}}'.
+var placeholderRegex = regexp.MustCompile(`\{\{\s*\.(File|Files|Dir)\s*\}\}`)
+
+func newCmdTemplateData(changedFiles []string, shell bool) cmdTemplateData {
+	data := cmdTemplateData{Dir: "."}
+	if len(changedFiles) == 0 {
+		return data
+	}
+
+	quoted := []string{}
+	for _, file := range changedFiles {
+		quoted = append(quoted, quoteWord(file, shell))
+	}
+
+	lastFile := changedFiles[len(changedFiles)-1]
+	data.File = quoteWord(lastFile, shell)
+	data.Files = strings.Join(quoted, " ")
+	data.Dir = quoteWord(filepath.ToSlash(filepath.Dir(lastFile)), shell)
+	return data
+}
+
+// hasPlaceholders returns true if the command contains any of the placeholders
+func hasPlaceholders(cmd string) bool {
+	return placeholderRegex.MatchString(cmd)
+}
+
+// expandCmd fills in the placeholders of the given command, quoted for the shell
+// if it is run in one
+func expandCmd(cmd string, changedFiles []string, shell bool) string {
+	data := newCmdTemplateData(changedFiles, shell)
+	return placeholderRegex.ReplaceAllStringFunc(cmd, func(placeholder string) string {
+		switch placeholderRegex.FindStringSubmatch(placeholder)[1] {
+		case "File":
+			return data.File
+		case "Files":
+			return data.Files
+		default:
+			return data.Dir
+		}
+	})
+}
+
+// changedFilesEnv returns the environment variables describing the changed files
+func changedFilesEnv(changedFiles []string) []string {
+	lastFile := ""
+	if len(changedFiles) > 0 {
+		lastFile = changedFiles[len(changedFiles)-1]
+	}
+	return []string{
+		EnvChangedFiles + "=" + strings.Join(changedFiles, string(os.PathListSeparator)),
+		EnvChangedFile + "=" + lastFile,
+	}
+}
+
+// quoteWord quotes a word, so it is kept as one when parsed by shellwords or the shell
+func quoteWord(word string, shell bool) string {
+	if shell {
+		return util.QuoteShellWord(word)
+	}
+	return "'" + strings.Replace(word, "'", `'"'"'`, -1) + "'"
+}
@@ -0,0 +1,292 @@
+package wado
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// InstanceStatus is the state of an instance as reported by the control server
+type InstanceStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	Paused  bool   `json:"paused"`
+}
+
+// ControlServer lets other processes control a running group over a Unix socket,
+// using HTTP requests with JSON responses:
+//
+//	GET  /instances                 status of all the instances
+//	POST /instances/<name>/restart  restart the main chain
+//	POST /instances/<name>/pause    stop acting on changes
+//	POST /instances/<name>/resume   act on changes again
+//	GET  /instances/<name>/output   recent output, and with ?follow=true all output after that
+type ControlServer struct {
+	group      *Group
+	socketPath string
+	listener   net.Listener
+	server     *http.Server
+	closed     chan bool
+}
+
+// ServeControl starts serving the control API for the group on the given socket
+func ServeControl(group *Group, socketPath string) (*ControlServer, error) {
+	// A socket file left behind by a wado process that did not exit cleanly is removed
+	if _, err := os.Stat(socketPath); err == nil {
+		conn, err := net.DialTimeout("unix", socketPath, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("wado is already running on %v", socketPath)
+		}
+		os.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ControlServer{
+		group:      group,
+		socketPath: socketPath,
+		listener:   listener,
+		closed:     make(chan bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/instances", s.handleInstances)
+	mux.HandleFunc("/instances/", s.handleInstance)
+	s.server = &http.Server{Handler: mux}
+
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("Error in the control server:", err)
+		}
+	}()
+	return s, nil
+}
+
+// Close stops the control server and removes the socket
+func (s *ControlServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	close(s.closed)
+	err := s.server.Shutdown(ctx)
+	os.Remove(s.socketPath)
+	return err
+}
+
+func (s *ControlServer) handleInstances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := []InstanceStatus{}
+	for _, instance := range s.group.currentInstances() {
+		statuses = append(statuses, instanceStatus(instance))
+	}
+	writeJSON(w, statuses)
+}
+
+func instanceStatus(instance *wadoInstance) InstanceStatus {
+	return InstanceStatus{
+		Name:    instance.Name(),
+		Running: instance.IsRunning(),
+		Paused:  instance.IsPaused(),
+	}
+}
+
+// handleInstance handles the actions on a single instance, e.g. POST /instances/api/restart
+func (s *ControlServer) handleInstance(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/instances/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name, action := parts[0], parts[1]
+
+	instance := s.group.instance(name)
+	if instance == nil {
+		http.Error(w, "unknown instance: "+name, http.StatusNotFound)
+		return
+	}
+
+	if action == "output" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.streamOutput(w, r, instance)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch action {
+	case "restart":
+		go instance.Restart()
+	case "pause":
+		instance.Pause()
+	case "resume":
+		instance.Resume()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, instanceStatus(instance))
+}
+
+// streamOutput writes the recent output of the instance, and if following,
+// keeps writing its output until the client disconnects
+func (s *ControlServer) streamOutput(w http.ResponseWriter, r *http.Request, instance *wadoInstance) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.URL.Query().Get("follow") != "true" {
+		w.Write(instance.output.Recent())
+		return
+	}
+
+	recent, output, unsubscribe := instance.output.Follow()
+	defer unsubscribe()
+
+	flusher, _ := w.(http.Flusher)
+	write := func(p []byte) bool {
+		if _, err := w.Write(p); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	if !write(recent) {
+		return
+	}
+	for {
+		select {
+		case p := <-output:
+			if !write(p) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Println("Error writing control response:", err)
+	}
+}
+
+// ControlClient talks to the control server of a running wado process
+type ControlClient struct {
+	client *http.Client
+}
+
+// NewControlClient creates a client for the control server on the given socket
+func NewControlClient(socketPath string) *ControlClient {
+	return &ControlClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					dialer := net.Dialer{}
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Status returns the status of all the instances of the running group
+func (c *ControlClient) Status() ([]InstanceStatus, error) {
+	statuses := []InstanceStatus{}
+	err := c.do(http.MethodGet, "/instances", &statuses)
+	return statuses, err
+}
+
+// Trigger restarts the main chain of the instance with the given name
+func (c *ControlClient) Trigger(name string) error {
+	return c.instanceAction(name, "restart")
+}
+
+// Pause stops the instance with the given name from acting on changes
+func (c *ControlClient) Pause(name string) error {
+	return c.instanceAction(name, "pause")
+}
+
+// Resume makes the instance with the given name act on changes again
+func (c *ControlClient) Resume(name string) error {
+	return c.instanceAction(name, "resume")
+}
+
+// Output copies the recent output of the instance with the given name to the
+// writer. When following, it keeps copying new output until the server stops.
+func (c *ControlClient) Output(name string, follow bool, w io.Writer) error {
+	path := "/instances/" + url.PathEscape(name) + "/output"
+	if follow {
+		path += "?follow=true"
+	}
+	resp, err := c.request(http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (c *ControlClient) instanceAction(name string, action string) error {
+	return c.do(http.MethodPost, "/instances/"+url.PathEscape(name)+"/"+action, nil)
+}
+
+func (c *ControlClient) do(method string, path string, result interface{}) error {
+	resp, err := c.request(method, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// request sends the request, and turns error responses into errors
+func (c *ControlClient) request(method string, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://wado"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New(strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
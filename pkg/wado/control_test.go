@@ -0,0 +1,93 @@
+package wado
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ControlServer(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	outFile := filepath.Join(tmpDir, "out.txt")
+
+	group, err := NewGroup([]Config{
+		{Name: "api", Cmds: []CmdConfig{{Run: "echo api >> '" + outFile + "'", Shell: true}}},
+		{Name: "worker", Cmds: []CmdConfig{{Run: "sleep 10"}}},
+	})
+	require.NoError(t, err)
+	defer group.Kill()
+
+	socketPath := filepath.Join(tmpDir, "wado.sock")
+	server, err := ServeControl(group, socketPath)
+	require.NoError(t, err)
+	defer server.Close()
+
+	_, err = ServeControl(group, socketPath)
+	assert.Error(t, err)
+
+	<-time.After(100 * time.Millisecond)
+	client := NewControlClient(socketPath)
+	statuses, err := client.Status()
+	require.NoError(t, err)
+	assert.Equal(t, []InstanceStatus{
+		{Name: "api", Running: false, Paused: false},
+		{Name: "worker", Running: true, Paused: false},
+	}, statuses)
+
+	require.NoError(t, client.Trigger("api"))
+	<-time.After(200 * time.Millisecond)
+	content, err := ioutil.ReadFile(outFile)
+	require.NoError(t, err)
+	assert.Equal(t, "api\napi\n", string(content))
+
+	assert.EqualError(t, client.Trigger("web"), "unknown instance: web")
+
+	require.NoError(t, client.Pause("worker"))
+	statuses, err = client.Status()
+	require.NoError(t, err)
+	assert.True(t, statuses[1].Paused)
+	require.NoError(t, client.Resume("worker"))
+	statuses, err = client.Status()
+	require.NoError(t, err)
+	assert.False(t, statuses[1].Paused)
+}
+
+func Test_ControlServerOutput(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	group, err := NewGroup([]Config{
+		{Name: "api", Cmds: []CmdConfig{{Run: "echo first; sleep 0.2; echo second", Shell: true}}},
+	})
+	require.NoError(t, err)
+	defer group.Kill()
+
+	server, err := ServeControl(group, filepath.Join(tmpDir, "wado.sock"))
+	require.NoError(t, err)
+	client := NewControlClient(filepath.Join(tmpDir, "wado.sock"))
+
+	<-time.After(100 * time.Millisecond)
+	recent := &bytes.Buffer{}
+	require.NoError(t, client.Output("api", false, recent))
+	assert.Equal(t, "first\n", recent.String())
+
+	// Following keeps streaming the output until the server is closed
+	followed := &bytes.Buffer{}
+	done := make(chan error)
+	go func() {
+		done <- client.Output("api", true, followed)
+	}()
+	<-time.After(300 * time.Millisecond)
+	server.Close()
+	require.NoError(t, <-done)
+	assert.Equal(t, "first\nsecond\n", followed.String())
+}
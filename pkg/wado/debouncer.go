@@ -0,0 +1,130 @@
+package wado
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The debounce modes that decide when a burst of changes restarts the command chain.
+// Leading restarts on the first change of a burst, trailing restarts once the burst
+// is over, and both does the former and then the latter if more changes came in.
+const (
+	DebounceLeading  = "leading"
+	DebounceTrailing = "trailing"
+	DebounceBoth     = "both"
+)
+
+// debouncer collects changed files into bursts, and calls the trigger with the
+// files changed, at the start and/or end of each burst depending on the mode
+type debouncer struct {
+	delay   time.Duration
+	mode    string
+	trigger func(changedFiles []string)
+
+	// Changed files not yet acted on, and the timer ending the current burst
+	pending     []string
+	burstTimer  *time.Timer
+	burstNumber int
+	stopped     bool
+	mutex       *sync.Mutex
+}
+
+func newDebouncer(delay time.Duration, mode string, trigger func([]string)) (*debouncer, error) {
+	switch mode {
+	case DebounceLeading, DebounceTrailing, DebounceBoth:
+	case "":
+		mode = DebounceBoth
+	default:
+		return nil, fmt.Errorf("unknown debounce mode: %v", mode)
+	}
+
+	return &debouncer{
+		delay:   delay,
+		mode:    mode,
+		trigger: trigger,
+		pending: []string{},
+		mutex:   &sync.Mutex{},
+	}, nil
+}
+
+// Add collects the changed file into the current burst of changes, and
+// restarts the burst timer
+func (d *debouncer) Add(filePath string) {
+	d.mutex.Lock()
+	if d.stopped {
+		d.mutex.Unlock()
+		return
+	}
+
+	if !containsString(d.pending, filePath) {
+		d.pending = append(d.pending, filePath)
+	}
+
+	// The first change in a burst triggers right away, unless we only act at the end of bursts
+	var changedFiles []string
+	if d.burstTimer == nil && d.mode != DebounceTrailing {
+		changedFiles = d.takePending()
+	}
+
+	if d.burstTimer != nil {
+		d.burstTimer.Stop()
+	}
+	d.burstNumber++
+	burstNumber := d.burstNumber
+	d.burstTimer = time.AfterFunc(d.delay, func() {
+		d.burstEnded(burstNumber)
+	})
+	d.mutex.Unlock()
+
+	// Triggering may take a while, so it is done without holding up other changes
+	if changedFiles != nil {
+		d.trigger(changedFiles)
+	}
+}
+
+// Stop stops the debouncer from triggering any more
+func (d *debouncer) Stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.stopped = true
+	if d.burstTimer != nil {
+		d.burstTimer.Stop()
+	}
+}
+
+// burstEnded is called when no changes have been seen for the debounce duration
+func (d *debouncer) burstEnded(burstNumber int) {
+	d.mutex.Lock()
+
+	// A newer change has restarted the burst timer, or we have been stopped
+	if burstNumber != d.burstNumber || d.stopped {
+		d.mutex.Unlock()
+		return
+	}
+	d.burstTimer = nil
+
+	changedFiles := d.takePending()
+	d.mutex.Unlock()
+
+	if d.mode != DebounceLeading && len(changedFiles) > 0 {
+		d.trigger(changedFiles)
+	}
+}
+
+// takePending returns the pending changes and clears them. Must hold the mutex.
+func (d *debouncer) takePending() []string {
+	changedFiles := d.pending
+	d.pending = []string{}
+	return changedFiles
+}
+
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package wado
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+type triggerRecorder struct {
+	triggers [][]string
+	mutex    sync.Mutex
+}
+
+func (r *triggerRecorder) trigger(changedFiles []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.triggers = append(r.triggers, changedFiles)
+}
+
+func (r *triggerRecorder) Triggers() [][]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.triggers
+}
+
+func newTestDebouncer(t *testing.T, mode string) (*debouncer, *triggerRecorder) {
+	recorder := &triggerRecorder{}
+	d, err := newDebouncer(30*time.Millisecond, mode, recorder.trigger)
+	require.NoError(t, err)
+	return d, recorder
+}
+
+func sendBurst(d *debouncer) {
+	for _, file := range []string{"a.go", "b.go", "a.go", "c.go"} {
+		d.Add(file)
+		<-time.After(5 * time.Millisecond)
+	}
+}
+
+func Test_DebounceLeading(t *testing.T) {
+	d, recorder := newTestDebouncer(t, DebounceLeading)
+	sendBurst(d)
+	assert.Equal(t, [][]string{{"a.go"}}, recorder.Triggers())
+
+	<-time.After(60 * time.Millisecond)
+	assert.Equal(t, [][]string{{"a.go"}}, recorder.Triggers())
+}
+
+func Test_DebounceTrailing(t *testing.T) {
+	d, recorder := newTestDebouncer(t, DebounceTrailing)
+	sendBurst(d)
+	assert.Len(t, recorder.Triggers(), 0)
+
+	<-time.After(60 * time.Millisecond)
+	assert.Equal(t, [][]string{{"a.go", "b.go", "c.go"}}, recorder.Triggers())
+}
+
+func Test_DebounceBoth(t *testing.T) {
+	d, recorder := newTestDebouncer(t, DebounceBoth)
+	sendBurst(d)
+	assert.Len(t, recorder.Triggers(), 1)
+
+	<-time.After(60 * time.Millisecond)
+	assert.Equal(t, [][]string{{"a.go"}, {"b.go", "a.go", "c.go"}}, recorder.Triggers())
+
+	// A single change only triggers once
+	d.Add("a.go")
+	<-time.After(60 * time.Millisecond)
+	assert.Len(t, recorder.Triggers(), 3)
+}
+
+func Test_DebounceStop(t *testing.T) {
+	d, recorder := newTestDebouncer(t, DebounceTrailing)
+	sendBurst(d)
+	d.Stop()
+
+	<-time.After(60 * time.Millisecond)
+	assert.Len(t, recorder.Triggers(), 0)
+}
+
+func Test_DebounceUnknownMode(t *testing.T) {
+	_, err := newDebouncer(time.Millisecond, "middle", func([]string) {})
+	assert.EqualError(t, err, "unknown debounce mode: middle")
+}
+
+func Test_DebounceSlowTrigger(t *testing.T) {
+	triggered := make(chan []string, 10)
+	release := make(chan bool)
+	d, err := newDebouncer(30*time.Millisecond, DebounceBoth, func(changedFiles []string) {
+		triggered <- changedFiles
+		<-release
+	})
+	require.NoError(t, err)
+	defer d.Stop()
+
+	go d.Add("a.go")
+	assert.Equal(t, []string{"a.go"}, <-triggered)
+
+	// Changes are still collected while the trigger is busy
+	added := make(chan bool)
+	go func() {
+		d.Add("b.go")
+		added <- true
+	}()
+	select {
+	case <-added:
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "Adding a change was blocked by the trigger")
+	}
+	close(release)
+	assert.Equal(t, []string{"b.go"}, <-triggered)
+}
+
+func Test_ConfigDebounceYaml(t *testing.T) {
+	var config Config
+	require.NoError(t, yaml.Unmarshal([]byte("{debounce: 200, mode: trailing}"), &config))
+	assert.Equal(t, 200*time.Millisecond, config.Debounce)
+	assert.Equal(t, DebounceTrailing, config.Mode)
+
+	var other Config
+	require.NoError(t, yaml.Unmarshal([]byte("debounce: 1.5s"), &other))
+	assert.Equal(t, 1500*time.Millisecond, other.Debounce)
+}
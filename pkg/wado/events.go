@@ -0,0 +1,90 @@
+package wado
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// The types of events emitted
+const (
+	EventFileChanged   = "fileChanged"
+	EventChainStarted  = "chainStarted"
+	EventChainFinished = "chainFinished"
+	EventStepStarted   = "stepStarted"
+	EventStepFinished  = "stepFinished"
+	EventProcessKilled = "processKilled"
+	EventWatcherError  = "watcherError"
+)
+
+// Event is something that happened in a watcher or runner. Only the fields
+// relevant for the type of event are set.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Instance string    `json:"instance,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Op       string    `json:"op,omitempty"`
+	Files    []string  `json:"files,omitempty"`
+	Step     *int      `json:"step,omitempty"`
+	Command  []string  `json:"command,omitempty"`
+	ExitCode *int      `json:"exitCode,omitempty"`
+	Success  *bool     `json:"success,omitempty"`
+	Killed   bool      `json:"killed,omitempty"`
+	Duration float64   `json:"durationMs,omitempty"`
+	Pid      int       `json:"pid,omitempty"`
+	Signal   string    `json:"signal,omitempty"`
+
+	// Escalated is set when the process did not stop on its stop signals and had to be killed
+	Escalated bool   `json:"escalated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+var eventEncoder *json.Encoder
+var eventLock = &sync.Mutex{}
+
+// SetEventWriter makes all events be written to the writer as newline-delimited
+// JSON. Nil stops writing events.
+func SetEventWriter(writer io.Writer) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+
+	if writer == nil {
+		eventEncoder = nil
+	} else {
+		eventEncoder = json.NewEncoder(writer)
+	}
+}
+
+func emitEvent(event Event) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+
+	if eventEncoder == nil {
+		return
+	}
+	event.Time = time.Now()
+	if err := eventEncoder.Encode(event); err != nil {
+		log.Println("Error writing event:", err)
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// watcherError logs an error from a watcher, and emits it as an event
+func watcherError(message string, path string, err error) {
+	log.Println(message, err)
+	emitEvent(Event{Type: EventWatcherError, Path: path, Error: err.Error()})
+}
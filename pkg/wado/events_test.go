@@ -0,0 +1,134 @@
+package wado
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mktange/wado/internal/pkg/syncimpls"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readEvents(t *testing.T, output string) []Event {
+	events := []Event{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var event Event
+		require.NoError(t, json.Unmarshal([]byte(line), &event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func eventTypes(events []Event) []string {
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func Test_ChainEvents(t *testing.T) {
+	buffer := syncimpls.NewSyncBuffer()
+	SetEventWriter(buffer)
+	defer SetEventWriter(nil)
+
+	chain, err := NewCmdChain("echo Foo", "sh -c 'exit 2'")
+	require.NoError(t, err)
+	chain.SetInstanceName("api")
+	chain.Start("a.go")
+	chain.Wait()
+
+	events := readEvents(t, buffer.String())
+	assert.Equal(t, []string{
+		EventChainStarted,
+		EventStepStarted, EventStepFinished,
+		EventStepStarted, EventStepFinished,
+		EventChainFinished,
+	}, eventTypes(events))
+
+	for _, event := range events {
+		assert.Equal(t, "api", event.Instance)
+	}
+	assert.Equal(t, []string{"a.go"}, events[0].Files)
+	assert.Equal(t, []string{"echo", "Foo"}, events[2].Command)
+	assert.Equal(t, 0, *events[2].ExitCode)
+	assert.True(t, *events[2].Success)
+	assert.Equal(t, 1, *events[4].Step)
+	assert.Equal(t, 2, *events[4].ExitCode)
+	assert.False(t, *events[4].Success)
+	assert.False(t, *events[5].Success)
+}
+
+func Test_KillEvents(t *testing.T) {
+	buffer := syncimpls.NewSyncBuffer()
+	SetEventWriter(buffer)
+	defer SetEventWriter(nil)
+
+	runner, err := NewCmdRunnerFromConfig(CmdConfig{Run: "sleep 10"})
+	require.NoError(t, err)
+	runner.SetInstanceName("api")
+	require.NoError(t, runner.Start())
+	<-time.After(50 * time.Millisecond)
+	require.NoError(t, runner.Kill())
+
+	// Ignoring the stop signal makes the kill escalate
+	stubborn, err := NewCmdRunnerFromConfig(CmdConfig{
+		Run:   "trap '' TERM; sleep 10",
+		Shell: true,
+		Stop:  &StopConfig{Signal: "SIGTERM", Timeout: 100 * time.Millisecond},
+	})
+	require.NoError(t, err)
+	require.NoError(t, stubborn.Start())
+	<-time.After(50 * time.Millisecond)
+	require.NoError(t, stubborn.Kill())
+
+	events := readEvents(t, buffer.String())
+	require.Len(t, events, 2)
+	assert.Equal(t, EventProcessKilled, events[0].Type)
+	assert.Equal(t, "api", events[0].Instance)
+	assert.Equal(t, "SIGINT", events[0].Signal)
+	assert.False(t, events[0].Escalated)
+	assert.Equal(t, "SIGKILL", events[1].Signal)
+	assert.True(t, events[1].Escalated)
+}
+
+func Test_FileChangedEvents(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	buffer := syncimpls.NewSyncBuffer()
+	SetEventWriter(buffer)
+	defer SetEventWriter(nil)
+
+	m, err := newInstance(Config{
+		Name:         "api",
+		Watcher:      WatcherFsNotify,
+		IncludeGlobs: []string{filepath.Join(tmpDir, "*.txt")},
+	})
+	require.NoError(t, err)
+	defer m.Kill()
+	require.NoError(t, m.start())
+
+	aTxtFile := filepath.Join(tmpDir, "a.txt")
+	require.NoError(t, ioutil.WriteFile(aTxtFile, []byte("a"), 0644))
+
+	var changed *Event
+	for i := 0; i < 100 && changed == nil; i++ {
+		<-time.After(20 * time.Millisecond)
+		for _, event := range readEvents(t, buffer.String()) {
+			if event.Type == EventFileChanged {
+				changed = &event
+				break
+			}
+		}
+	}
+	require.NotNil(t, changed, "No fileChanged event")
+	assert.Equal(t, aTxtFile, changed.Path)
+	assert.Equal(t, TriggerCreate, changed.Op)
+}
@@ -1,31 +1,64 @@
 package wado
 
 import (
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
-	zglob "github.com/mattn/go-zglob"
 	"github.com/mattn/go-zglob/fastwalk"
+	"github.com/mktange/wado/internal/pkg/ignore"
 	"github.com/mktange/wado/internal/pkg/syncimpls"
 	"github.com/mktange/wado/internal/pkg/util"
 )
 
+// fsnotifyWatcher watches all its directories with a single fsnotify watcher,
+// whose events are handled by a single goroutine. More globs can be added to
+// it after it is created, which is how it is shared by instances.
 type fsnotifyWatcher struct {
-	includeGlobs    []string
-	excludeGlobs    []string
-	includeDirRegex []*regexp.Regexp
-	changeChans     []chan string
+	globs       []*fsnotifyGlobs
+	globLock    *sync.Mutex
+	ignorer     *ignore.Matcher
+	changeChans []chan string
+
+	fsWatch   *fsnotify.Watcher
+	loopDone  chan bool
+	sideWork  *sync.WaitGroup
+	closeOnce *sync.Once
 
 	watchedFiles  *syncimpls.MapStringFileStats
-	watchedDirs   *syncimpls.MapStringFsWatch
+	watchedDirs   *syncimpls.MapStringString
+	triggers      map[string]bool
 	callbackFuncs []func(string)
+	opCallbacks   []func(string, string)
 	callbackLock  *sync.Mutex
+
+	// Files removed or renamed, which are only reported as such if they do not
+	// come back right away as part of an atomic save, and new files, which are
+	// only reported if they are not moved away right away, like temporary files
+	// of atomic saves are
+	pendingRemovals map[string]*pendingRemoval
+	pendingCreates  map[string]*time.Timer
+	pendingLock     *sync.Mutex
+}
+
+// fsnotifyGlobs are the globs added to the watcher together, which are removed together as well
+type fsnotifyGlobs struct {
+	matcher  *globMatcher
+	dirRegex []*regexp.Regexp
+}
+
+type pendingRemoval struct {
+	op    string
+	timer *time.Timer
 }
 
+// How long a removed or renamed file has to be replaced in, or a new file has
+// to be moved away in, for it to count as an atomic save
+const atomicSaveWindow = 100 * time.Millisecond
+
 func (watcher *fsnotifyWatcher) FileCount() int {
 	return watcher.watchedFiles.Size()
 }
@@ -36,9 +69,33 @@ func (watcher *fsnotifyWatcher) CreateChangeChannel() chan string {
 	return newChan
 }
 
+// Close stops watching, and returns once the events are no longer handled
 func (watcher *fsnotifyWatcher) Close() error {
-	watcher.watchedFiles.Clear()
-	return watcher.watchedDirs.ClearAndClose()
+	var err error
+	watcher.closeOnce.Do(func() {
+		err = watcher.fsWatch.Close()
+		<-watcher.loopDone
+
+		watcher.pendingLock.Lock()
+		for fPath, pending := range watcher.pendingRemovals {
+			if pending.timer.Stop() {
+				watcher.sideWork.Done()
+			}
+			delete(watcher.pendingRemovals, fPath)
+		}
+		for fPath, timer := range watcher.pendingCreates {
+			if timer.Stop() {
+				watcher.sideWork.Done()
+			}
+			delete(watcher.pendingCreates, fPath)
+		}
+		watcher.pendingLock.Unlock()
+
+		watcher.sideWork.Wait()
+		watcher.watchedFiles.Clear()
+		watcher.watchedDirs.Clear()
+	})
+	return err
 }
 
 func (watcher *fsnotifyWatcher) AddCallback(cb func(string)) {
@@ -47,49 +104,154 @@ func (watcher *fsnotifyWatcher) AddCallback(cb func(string)) {
 	watcher.callbackLock.Unlock()
 }
 
+// addOpCallback adds a callback getting every kind of change, along with the kind
+func (watcher *fsnotifyWatcher) addOpCallback(cb func(string, string)) {
+	watcher.callbackLock.Lock()
+	watcher.opCallbacks = append(watcher.opCallbacks, cb)
+	watcher.callbackLock.Unlock()
+}
+
 // NewFsNotifyWatcher creates a new watcher based on the given configurations using fsnotify.
-// Changes are posted on the channel that can be gotten with GetChannel()
-func NewFsNotifyWatcher(includeGlobs []string, excludeGlobs []string) (Watcher, error) {
-	includeDirRegex := []*regexp.Regexp{}
-	for _, glob := range includeGlobs {
-		includeDirRegex = append(includeDirRegex, util.GetCouldDirMatchRegex(glob))
+// Changes are posted on the channel that can be gotten with GetChannel(), for
+// the default triggers. A file replaced by an atomic save is posted as written.
+// Directories ignored by .wadoignore files, and with gitIgnore also by .gitignore
+// files, are never watched.
+func NewFsNotifyWatcher(includeGlobs []string, excludeGlobs []string, gitIgnore bool) (Watcher, error) {
+	watcher, err := newFsNotifyWatcher(gitIgnore)
+	if err != nil {
+		return nil, err
+	}
+	_, err = watcher.addGlobs(includeGlobs, excludeGlobs)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// newFsNotifyWatcher creates a watcher without any globs, watching nothing yet
+func newFsNotifyWatcher(gitIgnore bool) (*fsnotifyWatcher, error) {
+	fsWatch, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
 	}
 
 	watcher := &fsnotifyWatcher{
-		includeGlobs:    includeGlobs,
-		excludeGlobs:    excludeGlobs,
-		includeDirRegex: includeDirRegex,
-		changeChans:     []chan string{},
+		globs:       []*fsnotifyGlobs{},
+		globLock:    &sync.Mutex{},
+		ignorer:     newIgnoreMatcher(gitIgnore),
+		changeChans: []chan string{},
+
+		fsWatch:   fsWatch,
+		loopDone:  make(chan bool),
+		sideWork:  &sync.WaitGroup{},
+		closeOnce: &sync.Once{},
 
 		watchedFiles:  syncimpls.NewMapStringFileStats(),
-		watchedDirs:   syncimpls.NewMapStringFsWatch(),
+		watchedDirs:   syncimpls.NewMapStringString(),
 		callbackFuncs: []func(string){},
+		opCallbacks:   []func(string, string){},
 		callbackLock:  &sync.Mutex{},
+
+		pendingRemovals: map[string]*pendingRemoval{},
+		pendingCreates:  map[string]*time.Timer{},
+		pendingLock:     &sync.Mutex{},
 	}
+	watcher.triggers, _ = triggerSet(nil)
+	go watcher.handleEvents()
+	return watcher, nil
+}
 
+// addGlobs starts watching the files matching the include globs and none of the
+// exclude globs, besides what is already watched. It returns a function removing
+// the globs again. If watching fails, nothing is added.
+func (watcher *fsnotifyWatcher) addGlobs(includeGlobs []string, excludeGlobs []string) (func(), error) {
+	// The paths from fsnotify are absolute, so the globs have to be as well
+	matcher, err := newGlobMatcher(includeGlobs, excludeGlobs)
+	if err != nil {
+		return nil, err
+	}
+
+	globs := &fsnotifyGlobs{matcher: matcher, dirRegex: []*regexp.Regexp{}}
 	for _, glob := range includeGlobs {
-		baseDir := util.GetLowestDirToWatch(glob)
-		_, err := os.Stat(baseDir)
-		if err != nil {
+		globs.dirRegex = append(globs.dirRegex, util.GetCouldDirMatchRegex(glob))
+	}
+	watcher.globLock.Lock()
+	watcher.globs = append(watcher.globs, globs)
+	watcher.globLock.Unlock()
+
+	removeGlobs := func() { watcher.removeGlobs(globs) }
+	for _, glob := range includeGlobs {
+		if err := watcher.watchGlob(glob); err != nil {
+			removeGlobs()
 			return nil, err
 		}
-		fullPath, err := filepath.Abs(baseDir)
-		if err != nil {
-			return nil, err
+	}
+	return removeGlobs, nil
+}
+
+// watchGlob watches the directories and files for the glob, from the lowest
+// directory that can contain matches and down
+func (watcher *fsnotifyWatcher) watchGlob(glob string) error {
+	baseDir := util.GetLowestDirToWatch(glob)
+	_, err := os.Stat(baseDir)
+	if err != nil {
+		return err
+	}
+	fullPath, err := filepath.Abs(baseDir)
+	if err != nil {
+		return err
+	}
+	if watcher.ignorer.Ignored(fullPath, true) {
+		return nil
+	}
+	return watcher.walkAndWatch(fullPath)
+}
+
+// removeGlobs removes globs added before, and stops watching the directories
+// and files that none of the remaining globs need
+func (watcher *fsnotifyWatcher) removeGlobs(globs *fsnotifyGlobs) {
+	watcher.globLock.Lock()
+	for i, g := range watcher.globs {
+		if g == globs {
+			watcher.globs = append(watcher.globs[:i:i], watcher.globs[i+1:]...)
+			break
 		}
+	}
+	watcher.globLock.Unlock()
 
-		watcher.walkAndWatch(fullPath)
+	for fPath := range watcher.watchedFiles.Range() {
+		if !watcher.shouldWatchFile(fPath) {
+			watcher.watchedFiles.Delete(fPath)
+		}
+	}
+	for dirPath := range watcher.watchedDirs.Range() {
+		if !watcher.shouldWatchDir(dirPath) || watcher.excludesDir(dirPath) {
+			watcher.fsWatch.Remove(dirPath)
+			watcher.watchedDirs.Delete(dirPath)
+		}
 	}
+}
 
-	return watcher, nil
+// watchedPaths returns the paths of all the watched files
+func (watcher *fsnotifyWatcher) watchedPaths() []string {
+	paths := []string{}
+	for fPath := range watcher.watchedFiles.Range() {
+		paths = append(paths, fPath)
+	}
+	return paths
 }
 
 func (watcher *fsnotifyWatcher) walkAndWatch(watchPath string) error {
 	return fastwalk.FastWalk(watchPath, func(currentPath string, info os.FileMode) error {
 		var err error
 		if info.IsDir() {
+			if currentPath != watchPath && watcher.ignorer.IgnoredDir(currentPath) || watcher.excludesDir(currentPath) {
+				return filepath.SkipDir
+			}
 			err = watcher.watchDir(currentPath)
-		} else {
+		} else if _, watched := watcher.watchedFiles.Load(currentPath); !watched {
+			// Files already watched through other globs keep their stats
 			watcher.watchFileIfMatch(currentPath)
 		}
 		return err
@@ -98,47 +260,75 @@ func (watcher *fsnotifyWatcher) walkAndWatch(watchPath string) error {
 
 func (watcher *fsnotifyWatcher) watchFileIfMatch(fPath string) {
 	if watcher.shouldWatchFile(fPath) {
+		if fi, err := os.Stat(fPath); err == nil && util.IsSpecialFile(fi.Mode()) {
+			return
+		}
 		fs, err := util.GetFileStats(fPath)
 		if err != nil {
-			log.Println("Error when checking file:", err)
+			watcherError("Error when checking file:", fPath, err)
 		}
 		watcher.watchedFiles.Store(fPath, fs)
 	}
 }
 
 func (watcher *fsnotifyWatcher) shouldWatchDir(fPath string) bool {
-	for _, regex := range watcher.includeDirRegex {
-		couldMatch, err := util.CouldDirMatch(regex, fPath)
-		if err == nil && couldMatch {
-			return true
+	watcher.globLock.Lock()
+	defer watcher.globLock.Unlock()
+
+	for _, globs := range watcher.globs {
+		for _, regex := range globs.dirRegex {
+			couldMatch, err := util.CouldDirMatch(regex, fPath)
+			if err == nil && couldMatch {
+				return true
+			}
 		}
 	}
 	return false
 }
 
 func (watcher *fsnotifyWatcher) shouldWatchFile(fPath string) bool {
-	for _, fileGlob := range watcher.excludeGlobs {
-		matched, err := zglob.Match(fileGlob, fPath)
-		if err != nil {
-			panic(err)
+	for _, matcher := range watcher.matchers() {
+		if matcher.Match(fPath) {
+			return !watcher.ignorer.Ignored(fPath, false)
 		}
-		if matched {
+	}
+	return false
+}
+
+// excludesDir returns true if everything in the directory is excluded by all the globs
+func (watcher *fsnotifyWatcher) excludesDir(dirPath string) bool {
+	matchers := watcher.matchers()
+	for _, matcher := range matchers {
+		if !matcher.ExcludesDir(dirPath) {
 			return false
 		}
 	}
-	for _, fileGlob := range watcher.includeGlobs {
-		matched, err := zglob.Match(fileGlob, fPath)
-		if err != nil {
-			panic(err)
-		}
-		if matched {
-			return true
-		}
+	return len(matchers) > 0
+}
+
+// matchers returns the matchers of all the globs
+func (watcher *fsnotifyWatcher) matchers() []*globMatcher {
+	watcher.globLock.Lock()
+	defer watcher.globLock.Unlock()
+
+	matchers := []*globMatcher{}
+	for _, globs := range watcher.globs {
+		matchers = append(matchers, globs.matcher)
 	}
-	return false
+	return matchers
 }
 
-func (watcher *fsnotifyWatcher) changeDetected(filePath string) {
+func (watcher *fsnotifyWatcher) changeDetected(filePath string, op string) {
+	watcher.callbackLock.Lock()
+	defer watcher.callbackLock.Unlock()
+
+	for _, cb := range watcher.opCallbacks {
+		go cb(filePath, op)
+	}
+	if !watcher.triggers[op] {
+		return
+	}
+
 	for _, cb := range watcher.callbackFuncs {
 		go cb(filePath)
 	}
@@ -156,72 +346,263 @@ func (watcher *fsnotifyWatcher) watchDir(watchPath string) error {
 		return nil
 	}
 
-	fsWatch, err := fsnotify.NewWatcher()
+	err := watcher.fsWatch.Add(watchPath)
 	if err != nil {
 		return err
 	}
+	watcher.watchedDirs.Store(watchPath, "")
+	return nil
+}
 
-	err = fsWatch.Add(watchPath)
-	if err != nil {
-		return err
+// handleEvents handles the events of all the watched directories, until the
+// fsnotify watcher is closed
+func (watcher *fsnotifyWatcher) handleEvents() {
+	defer close(watcher.loopDone)
+
+	for {
+		select {
+		case event, ok := <-watcher.fsWatch.Events:
+			if !ok {
+				return
+			}
+			watcher.handleEvent(event)
+
+		case err, ok := <-watcher.fsWatch.Errors:
+			if !ok {
+				return
+			}
+			watcherError("Error while watching:", "", err)
+		}
 	}
-	watcher.watchedDirs.Store(watchPath, fsWatch)
+}
 
-	// Start listening on the events channel
+// onTheSide runs work adding or removing watches outside of the event loop, as
+// fsnotify can wait on the events being read on some platforms
+func (watcher *fsnotifyWatcher) onTheSide(work func()) {
+	watcher.sideWork.Add(1)
 	go func() {
-		for {
-			select {
-			case event := <-fsWatch.Events:
-				filePath := event.Name
-				fi, err := os.Stat(filePath)
-				if err != nil {
-					panic(err)
-				}
-				isDir := fi.Mode().IsDir()
-
-				if event.Op&fsnotify.Create == fsnotify.Create { // Created
-					if isDir {
-						watcher.watchDir(filePath)
-					} else {
-						watcher.watchFileIfMatch(filePath)
-					}
-
-				} else if event.Op&fsnotify.Remove == fsnotify.Remove { // Removed
-					if isDir {
-						if dir, ok := watcher.watchedDirs.Load(filePath); ok == true {
-							go dir.Close()
-							watcher.watchedDirs.Delete(filePath)
-						}
-
-					} else {
-						watcher.watchedFiles.Delete(filePath)
-					}
-
-				} else if event.Op&fsnotify.Write == fsnotify.Write { // Changed
-					if !isDir {
-						if fs, ok := watcher.watchedFiles.Load(filePath); ok == true {
-							newFs, changed, err := util.HasChanged(filePath, fs)
-							if err != nil {
-								log.Println("Error:", err)
-							}
-
-							if changed {
-								if newFs == nil {
-									watcher.watchedFiles.Delete(filePath)
-								} else {
-									watcher.watchedFiles.Store(filePath, newFs)
-									watcher.changeDetected(filePath)
-								}
-							}
-						}
-					}
-				}
+		defer watcher.sideWork.Done()
+		work()
+	}()
+}
+
+func (watcher *fsnotifyWatcher) isClosed() bool {
+	select {
+	case <-watcher.loopDone:
+		return true
+	default:
+		return false
+	}
+}
+
+func (watcher *fsnotifyWatcher) handleEvent(event fsnotify.Event) {
+	// Removed or renamed paths can no longer be stat'ed, so fall back
+	// on what we know about them
+	filePath := event.Name
+	isDir := false
+	if fi, err := os.Stat(filePath); err == nil {
+		isDir = fi.Mode().IsDir()
+	} else {
+		_, isDir = watcher.watchedDirs.Load(filePath)
+	}
 
-			case err := <-fsWatch.Errors:
-				log.Println("Error while watching:", err)
+	if isDir {
+		watcher.handleDirEvent(event)
+		return
+	}
+
+	// The rules of a changed ignore file are read again, and the directories
+	// they no longer ignore are watched from now on
+	if watcher.ignorer.Changed(filePath) {
+		dirPath := filepath.Dir(filePath)
+		watcher.onTheSide(func() {
+			err := watcher.walkAndWatch(dirPath)
+			if err != nil && !os.IsNotExist(err) && !watcher.isClosed() {
+				watcherError("Error when watching directory:", dirPath, err)
 			}
+		})
+	}
+
+	// A removed file may be coming back as part of an atomic save, which is
+	// checked once it is done. A new file moved away right after is not reported at all.
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		if !watcher.cancelCreate(filePath) {
+			watcher.removeLater(filePath, event.Op)
 		}
-	}()
+		return
+	}
+	if watcher.isPendingRemoval(filePath) || watcher.isPendingCreate(filePath) {
+		return
+	}
 
-	return nil
+	if event.Op&fsnotify.Create == fsnotify.Create { // Created, or moved here
+		if _, ok := watcher.watchedFiles.Load(filePath); ok == true {
+			// Replaced by another file moved here
+			watcher.checkFile(filePath)
+		} else {
+			watcher.watchFileIfMatch(filePath)
+			if _, ok := watcher.watchedFiles.Load(filePath); ok == true {
+				watcher.createLater(filePath)
+			}
+		}
+
+	} else if event.Op&(fsnotify.Write|fsnotify.Chmod) != 0 { // Changed
+		watcher.checkFile(filePath)
+	}
+}
+
+func (watcher *fsnotifyWatcher) handleDirEvent(event fsnotify.Event) {
+	dirPath := event.Name
+
+	if event.Op&fsnotify.Create == fsnotify.Create { // Created, or moved here
+		if !watcher.ignorer.Ignored(dirPath, true) && !watcher.excludesDir(dirPath) {
+			watcher.onTheSide(func() {
+				err := watcher.walkAndWatch(dirPath)
+				if err != nil && !os.IsNotExist(err) && !watcher.isClosed() {
+					watcherError("Error when watching directory:", dirPath, err)
+				}
+			})
+		}
+
+	} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 { // Removed, or moved away
+		if _, ok := watcher.watchedDirs.Load(dirPath); ok == true {
+			// The watch of a removed directory is usually gone already
+			watcher.onTheSide(func() { watcher.fsWatch.Remove(dirPath) })
+			watcher.watchedDirs.Delete(dirPath)
+		}
+	}
+}
+
+// checkFile posts a change if the watched file has been written to, or if its
+// mode has changed. A removed file is left to its remove event.
+func (watcher *fsnotifyWatcher) checkFile(filePath string) {
+	fs, ok := watcher.watchedFiles.Load(filePath)
+	if !ok {
+		return
+	}
+
+	newFs, changed, err := util.HasChanged(filePath, fs)
+	if err != nil {
+		watcherError("Error:", filePath, err)
+	}
+	if !changed || newFs == nil {
+		return
+	}
+
+	watcher.watchedFiles.Store(filePath, newFs)
+	watcher.changeDetected(filePath, changeOf(fs, newFs))
+}
+
+// removeLater posts the removal of a watched file, unless it is back shortly
+// after, as editors saving atomically replace the file by renaming a new one to
+// it. Then it is posted as a single write, if the content has changed.
+func (watcher *fsnotifyWatcher) removeLater(filePath string, fsOp fsnotify.Op) {
+	if _, ok := watcher.watchedFiles.Load(filePath); !ok {
+		return
+	}
+
+	op := TriggerRemove
+	if fsOp&fsnotify.Rename == fsnotify.Rename {
+		op = TriggerRename
+	}
+
+	watcher.pendingLock.Lock()
+	defer watcher.pendingLock.Unlock()
+
+	if _, pending := watcher.pendingRemovals[filePath]; pending {
+		return
+	}
+	watcher.sideWork.Add(1)
+	watcher.pendingRemovals[filePath] = &pendingRemoval{
+		op: op,
+		timer: time.AfterFunc(atomicSaveWindow, func() {
+			defer watcher.sideWork.Done()
+			watcher.finishRemoval(filePath)
+		}),
+	}
+}
+
+// createLater posts the creation of a new file, unless it is removed or moved
+// away shortly after, like the temporary file of an atomic save
+func (watcher *fsnotifyWatcher) createLater(filePath string) {
+	watcher.pendingLock.Lock()
+	defer watcher.pendingLock.Unlock()
+
+	if _, pending := watcher.pendingCreates[filePath]; pending {
+		return
+	}
+	watcher.sideWork.Add(1)
+	watcher.pendingCreates[filePath] = time.AfterFunc(atomicSaveWindow, func() {
+		defer watcher.sideWork.Done()
+		watcher.finishCreate(filePath)
+	})
+}
+
+func (watcher *fsnotifyWatcher) isPendingCreate(filePath string) bool {
+	watcher.pendingLock.Lock()
+	defer watcher.pendingLock.Unlock()
+	_, pending := watcher.pendingCreates[filePath]
+	return pending
+}
+
+// cancelCreate forgets a new file that is gone before its creation was posted,
+// and returns true if there was one
+func (watcher *fsnotifyWatcher) cancelCreate(filePath string) bool {
+	watcher.pendingLock.Lock()
+	defer watcher.pendingLock.Unlock()
+
+	timer, pending := watcher.pendingCreates[filePath]
+	if !pending {
+		return false
+	}
+	if timer.Stop() {
+		watcher.sideWork.Done()
+	}
+	delete(watcher.pendingCreates, filePath)
+	watcher.watchedFiles.Delete(filePath)
+	return true
+}
+
+// finishCreate posts the creation of the new file, with the stats it has by now
+func (watcher *fsnotifyWatcher) finishCreate(filePath string) {
+	watcher.pendingLock.Lock()
+	_, ok := watcher.pendingCreates[filePath]
+	delete(watcher.pendingCreates, filePath)
+	watcher.pendingLock.Unlock()
+
+	if !ok || watcher.isClosed() {
+		return
+	}
+	fs, err := util.GetFileStats(filePath)
+	if err != nil || fs == nil {
+		// Gone before its event came in, so there is nothing to post at all
+		watcher.watchedFiles.Delete(filePath)
+		return
+	}
+	watcher.watchedFiles.Store(filePath, fs)
+	watcher.changeDetected(filePath, TriggerCreate)
+}
+
+func (watcher *fsnotifyWatcher) isPendingRemoval(filePath string) bool {
+	watcher.pendingLock.Lock()
+	defer watcher.pendingLock.Unlock()
+	_, pending := watcher.pendingRemovals[filePath]
+	return pending
+}
+
+func (watcher *fsnotifyWatcher) finishRemoval(filePath string) {
+	watcher.pendingLock.Lock()
+	pending, ok := watcher.pendingRemovals[filePath]
+	delete(watcher.pendingRemovals, filePath)
+	watcher.pendingLock.Unlock()
+
+	if !ok || watcher.isClosed() {
+		return
+	}
+	if fi, err := os.Stat(filePath); err == nil && !fi.IsDir() {
+		watcher.checkFile(filePath)
+		return
+	}
+	watcher.watchedFiles.Delete(filePath)
+	watcher.changeDetected(filePath, pending.op)
 }
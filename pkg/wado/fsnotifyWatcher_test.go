@@ -2,9 +2,11 @@ package wado
 
 import (
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/mktange/wado/internal/pkg/util"
 	"github.com/stretchr/testify/assert"
@@ -25,7 +27,7 @@ func Test_Watch(t *testing.T) {
 	glob := filepath.Join(tmpDir, "**", "*.go")
 
 	// Setup watcher
-	watcher, err := NewFsNotifyWatcher([]string{glob}, []string{})
+	watcher, err := NewFsNotifyWatcher([]string{glob}, []string{}, false)
 	require.NoError(t, err)
 
 	changeChan := watcher.CreateChangeChannel()
@@ -67,7 +69,7 @@ func Test_NewSubDir(t *testing.T) {
 	glob := filepath.Join(tmpDir, "**", "*.go")
 
 	// Setup watcher
-	watcher, err := NewFsNotifyWatcher([]string{glob}, []string{})
+	watcher, err := NewFsNotifyWatcher([]string{glob}, []string{}, false)
 	require.NoError(t, err)
 
 	changeChan := watcher.CreateChangeChannel()
@@ -83,3 +85,294 @@ func Test_NewSubDir(t *testing.T) {
 	assert.True(t, changeHappened, "Change did not appear on channel")
 	assert.Len(t, changeChan, 0)
 }
+
+func Test_WatchSkipsIgnoredDirs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// The ignore files are read from the working directory and down
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+	require.NoError(t, os.Chdir(tmpDir))
+
+	require.NoError(t, ioutil.WriteFile(".gitignore", []byte("node_modules/\n"), os.ModePerm))
+	require.NoError(t, os.MkdirAll(filepath.Join("node_modules", "pkg"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("node_modules", "pkg", "a.go"), []byte("a"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile("b.go", []byte("b"), os.ModePerm))
+
+	glob := filepath.Join(tmpDir, "**", "*.go")
+
+	watcher, err := NewFsNotifyWatcher([]string{glob}, []string{}, true)
+	require.NoError(t, err)
+	defer watcher.Close()
+	assert.Equal(t, 1, watcher.FileCount())
+	_, watched := watcher.(*fsnotifyWatcher).watchedDirs.Load(filepath.Join(tmpDir, "node_modules"))
+	assert.False(t, watched)
+
+	watcher, err = NewPollWatcher([]string{glob}, []string{}, true, PollConfig{})
+	require.NoError(t, err)
+	defer watcher.Close()
+	assert.Equal(t, 1, watcher.FileCount())
+
+	// Without gitignore, only .wadoignore files are honored
+	watcher, err = NewPollWatcher([]string{glob}, []string{}, false, PollConfig{})
+	require.NoError(t, err)
+	defer watcher.Close()
+	assert.Equal(t, 2, watcher.FileCount())
+}
+
+func Test_WatchIgnoreFileChanged(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+	require.NoError(t, os.Chdir(tmpDir))
+
+	require.NoError(t, ioutil.WriteFile(".gitignore", []byte("vendor/\n"), os.ModePerm))
+	require.NoError(t, os.Mkdir("vendor", os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("vendor", "a.go"), []byte("a"), os.ModePerm))
+
+	watcher, err := NewFsNotifyWatcher([]string{filepath.Join(tmpDir, "**", "*.go")}, []string{}, true)
+	require.NoError(t, err)
+	defer watcher.Close()
+	assert.Equal(t, 0, watcher.FileCount())
+
+	// The directory is watched once it is no longer ignored
+	require.NoError(t, ioutil.WriteFile(".gitignore", []byte("*.log\n"), os.ModePerm))
+	for i := 0; i < 50 && watcher.FileCount() == 0; i++ {
+		<-time.After(20 * time.Millisecond)
+	}
+	assert.Equal(t, 1, watcher.FileCount())
+}
+
+func Test_WatchSkipsExcludedDirs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, dir := range []string{"vendor/pkg", "gen", "src"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, dir), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, dir, "a.go"), []byte("a"), os.ModePerm))
+	}
+
+	glob := filepath.Join(tmpDir, "**", "*.go")
+	excludeGlobs := []string{filepath.Join(tmpDir, "vendor", "**"), filepath.Join(tmpDir, "gen")}
+
+	watcher, err := NewFsNotifyWatcher([]string{glob}, excludeGlobs, false)
+	require.NoError(t, err)
+	defer watcher.Close()
+	assert.Equal(t, 1, watcher.FileCount())
+
+	fw := watcher.(*fsnotifyWatcher)
+	for _, dir := range []string{"vendor", "vendor/pkg", "gen"} {
+		_, watched := fw.watchedDirs.Load(filepath.Join(tmpDir, dir))
+		assert.False(t, watched, dir)
+	}
+	_, watched := fw.watchedDirs.Load(filepath.Join(tmpDir, "src"))
+	assert.True(t, watched)
+
+	// Everything in an excluded directory is excluded, at any depth
+	assert.False(t, fw.shouldWatchFile(filepath.Join(tmpDir, "vendor", "pkg", "a.go")))
+	assert.False(t, fw.shouldWatchFile(filepath.Join(tmpDir, "gen", "a.go")))
+	assert.True(t, fw.shouldWatchFile(filepath.Join(tmpDir, "src", "a.go")))
+}
+
+func Test_WatchNewNestedDirs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	watcher, err := NewFsNotifyWatcher([]string{filepath.Join(tmpDir, "**", "*.go")}, []string{}, false)
+	require.NoError(t, err)
+	defer watcher.Close()
+	changeChan := watcher.CreateChangeChannel()
+
+	// Directories created together are all watched, along with the files already in them
+	subDir := filepath.Join(tmpDir, "a", "b")
+	require.NoError(t, os.MkdirAll(subDir, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(subDir, "a.go"), []byte("a"), os.ModePerm))
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(subDir, "a.go"), []byte("b"), os.ModePerm))
+	assert.True(t, util.WaitForMessage(t, changeChan), "Change did not appear on channel")
+}
+
+func Test_WatchClose(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filePath := filepath.Join(tmpDir, "a.go")
+	require.NoError(t, ioutil.WriteFile(filePath, []byte("a"), os.ModePerm))
+
+	watcher, err := NewFsNotifyWatcher([]string{filepath.Join(tmpDir, "*.go")}, []string{}, false)
+	require.NoError(t, err)
+	changeChan := watcher.CreateChangeChannel()
+
+	// Once closed, the event loop is done and no more changes are posted
+	require.NoError(t, watcher.Close())
+	assert.True(t, watcher.(*fsnotifyWatcher).isClosed())
+	assert.NoError(t, watcher.Close())
+
+	require.NoError(t, ioutil.WriteFile(filePath, []byte("b"), os.ModePerm))
+	assert.False(t, util.WaitForMessage(t, changeChan), "Change should not appear on channel")
+}
+
+func Test_WatchSkipsDirsAndSockets(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), os.ModePerm))
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "logs"), os.ModePerm))
+	listener, err := net.Listen("unix", filepath.Join(tmpDir, "wado.sock"))
+	require.NoError(t, err)
+	defer listener.Close()
+
+	watcher, err := NewFsNotifyWatcher([]string{filepath.Join(tmpDir, "*")}, []string{}, false)
+	require.NoError(t, err)
+	defer watcher.Close()
+	assert.Equal(t, 1, watcher.FileCount())
+	ops := watchOps(watcher)
+
+	// Sockets and directories created while watching are left out as well
+	newListener, err := net.Listen("unix", filepath.Join(tmpDir, "new.sock"))
+	require.NoError(t, err)
+	defer newListener.Close()
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "cache"), os.ModePerm))
+
+	assert.Empty(t, collectOps(ops))
+	assert.Equal(t, 1, watcher.FileCount())
+}
+
+// watchOps returns a channel getting every change of the watcher, as path and kind of change
+func watchOps(watcher Watcher) chan [2]string {
+	ops := make(chan [2]string, 20)
+	watcher.(*fsnotifyWatcher).addOpCallback(func(filePath string, op string) {
+		ops <- [2]string{filepath.Base(filePath), op}
+	})
+	return ops
+}
+
+// collectOps returns the changes seen until none have come for 300ms
+func collectOps(ops chan [2]string) [][2]string {
+	result := [][2]string{}
+	for {
+		select {
+		case op := <-ops:
+			result = append(result, op)
+		case <-time.After(300 * time.Millisecond):
+			return result
+		}
+	}
+}
+
+func Test_WatchTriggers(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	aGoFile := filepath.Join(tmpDir, "a.go")
+	require.NoError(t, ioutil.WriteFile(aGoFile, []byte("a"), 0644))
+
+	watcher, err := NewFsNotifyWatcher([]string{filepath.Join(tmpDir, "*.go")}, []string{}, false)
+	require.NoError(t, err)
+	defer watcher.Close()
+	ops := watchOps(watcher)
+
+	bGoFile := filepath.Join(tmpDir, "b.go")
+	require.NoError(t, ioutil.WriteFile(bGoFile, []byte("b"), 0644))
+	assert.Equal(t, [][2]string{{"b.go", TriggerCreate}}, collectOps(ops))
+
+	require.NoError(t, os.Chmod(aGoFile, 0755))
+	assert.Equal(t, [][2]string{{"a.go", TriggerChmod}}, collectOps(ops))
+
+	require.NoError(t, os.Rename(bGoFile, filepath.Join(tmpDir, "b.txt")))
+	assert.Equal(t, [][2]string{{"b.go", TriggerRename}}, collectOps(ops))
+
+	require.NoError(t, os.Remove(aGoFile))
+	assert.Equal(t, [][2]string{{"a.go", TriggerRemove}}, collectOps(ops))
+	assert.Equal(t, 0, watcher.FileCount())
+}
+
+func Test_WatchAtomicSave(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	aGoFile := filepath.Join(tmpDir, "a.go")
+	require.NoError(t, ioutil.WriteFile(aGoFile, []byte("a"), 0644))
+
+	watcher, err := NewFsNotifyWatcher([]string{filepath.Join(tmpDir, "*.go")}, []string{}, false)
+	require.NoError(t, err)
+	defer watcher.Close()
+	ops := watchOps(watcher)
+	changeChan := watcher.CreateChangeChannel()
+
+	// Like vim, moving the file away to a backup and writing a new one
+	require.NoError(t, os.Rename(aGoFile, aGoFile+"~"))
+	require.NoError(t, ioutil.WriteFile(aGoFile, []byte("b"), 0644))
+	require.NoError(t, os.Remove(aGoFile+"~"))
+	assert.Equal(t, [][2]string{{"a.go", TriggerWrite}}, collectOps(ops))
+	assert.Len(t, changeChan, 1)
+	<-changeChan
+
+	// Like JetBrains safe write, writing a new file and moving it over the old one
+	tmpFile := aGoFile + "___jb_tmp___"
+	require.NoError(t, ioutil.WriteFile(tmpFile, []byte("c"), 0644))
+	require.NoError(t, os.Rename(aGoFile, aGoFile+"___jb_old___"))
+	require.NoError(t, os.Rename(tmpFile, aGoFile))
+	require.NoError(t, os.Remove(aGoFile+"___jb_old___"))
+	assert.Equal(t, [][2]string{{"a.go", TriggerWrite}}, collectOps(ops))
+
+	// Or just moving the new file over the old one
+	require.NoError(t, ioutil.WriteFile(tmpFile, []byte("d"), 0644))
+	require.NoError(t, os.Rename(tmpFile, aGoFile))
+	assert.Equal(t, [][2]string{{"a.go", TriggerWrite}}, collectOps(ops))
+
+	// Saving without changing the content is not a change
+	require.NoError(t, os.Rename(aGoFile, aGoFile+"~"))
+	require.NoError(t, ioutil.WriteFile(aGoFile, []byte("d"), 0644))
+	require.NoError(t, os.Remove(aGoFile+"~"))
+	assert.Empty(t, collectOps(ops))
+	assert.Equal(t, 1, watcher.FileCount())
+}
+
+func Test_WatchAtomicSaveBroadGlob(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	aGoFile := filepath.Join(tmpDir, "a.go")
+	require.NoError(t, ioutil.WriteFile(aGoFile, []byte("a"), 0644))
+
+	// The temporary files match the glob as well
+	watcher, err := NewFsNotifyWatcher([]string{filepath.Join(tmpDir, "**", "*")}, []string{}, false)
+	require.NoError(t, err)
+	defer watcher.Close()
+	ops := watchOps(watcher)
+
+	tmpFile := aGoFile + ".tmp~"
+	require.NoError(t, ioutil.WriteFile(tmpFile, []byte("b"), 0644))
+	require.NoError(t, os.Rename(tmpFile, aGoFile))
+	assert.Equal(t, [][2]string{{"a.go", TriggerWrite}}, collectOps(ops))
+
+	require.NoError(t, os.Rename(aGoFile, aGoFile+"~"))
+	require.NoError(t, ioutil.WriteFile(aGoFile, []byte("c"), 0644))
+	require.NoError(t, os.Remove(aGoFile+"~"))
+	assert.Equal(t, [][2]string{{"a.go", TriggerWrite}}, collectOps(ops))
+	assert.Equal(t, 1, watcher.FileCount())
+
+	// New files that stay are still reported, once
+	bGoFile := filepath.Join(tmpDir, "b.go")
+	f, err := os.Create(bGoFile)
+	require.NoError(t, err)
+	f.WriteString("b")
+	f.Close()
+	assert.Equal(t, [][2]string{{"b.go", TriggerCreate}}, collectOps(ops))
+}
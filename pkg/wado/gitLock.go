@@ -0,0 +1,69 @@
+package wado
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	gitLockCheckInterval = 100 * time.Millisecond
+
+	// Git takes and releases the lock for every step of e.g. a rebase, so the
+	// lock has to stay released for a while before git is considered done
+	gitLockQuietPeriod = time.Second
+)
+
+// gitLockMonitor tells when git starts and stops working on a repository, based
+// on whether the index.lock file exists in the .git directory
+type gitLockMonitor struct {
+	lockPath string
+	onChange func(locked bool)
+	stop     chan bool
+	stopped  chan bool
+}
+
+func newGitLockMonitor(gitDir string, onChange func(locked bool)) *gitLockMonitor {
+	monitor := &gitLockMonitor{
+		lockPath: filepath.Join(gitDir, "index.lock"),
+		onChange: onChange,
+		stop:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+	go monitor.run()
+	return monitor
+}
+
+func (g *gitLockMonitor) run() {
+	defer close(g.stopped)
+
+	locked := false
+	var lastSeen time.Time
+	ticker := time.NewTicker(gitLockCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := os.Stat(g.lockPath); err == nil {
+			lastSeen = time.Now()
+			if !locked {
+				locked = true
+				g.onChange(true)
+			}
+		} else if locked && time.Since(lastSeen) >= gitLockQuietPeriod {
+			locked = false
+			g.onChange(false)
+		}
+	}
+}
+
+// Stop stops monitoring the lock
+func (g *gitLockMonitor) Stop() {
+	close(g.stop)
+	<-g.stopped
+}
@@ -0,0 +1,43 @@
+package wado
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_GitLockMonitor(t *testing.T) {
+	gitDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(gitDir)
+
+	changes := make(chan bool, 10)
+	monitor := newGitLockMonitor(gitDir, func(locked bool) {
+		changes <- locked
+	})
+	defer monitor.Stop()
+
+	lockPath := filepath.Join(gitDir, "index.lock")
+	require.NoError(t, ioutil.WriteFile(lockPath, []byte{}, os.ModePerm))
+	assert.True(t, <-changes)
+
+	// Git releasing the lock briefly between steps does not count as done
+	require.NoError(t, os.Remove(lockPath))
+	<-time.After(300 * time.Millisecond)
+	require.NoError(t, ioutil.WriteFile(lockPath, []byte{}, os.ModePerm))
+	<-time.After(300 * time.Millisecond)
+	assert.Len(t, changes, 0)
+
+	require.NoError(t, os.Remove(lockPath))
+	select {
+	case locked := <-changes:
+		assert.False(t, locked)
+	case <-time.After(2 * gitLockQuietPeriod):
+		t.Fatal("the lock was not reported as released")
+	}
+}
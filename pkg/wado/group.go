@@ -0,0 +1,407 @@
+package wado
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Group runs a set of instances. Instances depending on others are started once
+// all their dependencies have run successfully, and are restarted every time
+// one of the dependencies runs successfully after that.
+type Group struct {
+	configs   []Config
+	instances []*wadoInstance
+	mutex     *sync.Mutex
+}
+
+// NewGroup creates and starts the instances of the given configurations, in
+// the order of their dependencies
+func NewGroup(configs []Config) (*Group, error) {
+	group := &Group{
+		configs:   []Config{},
+		instances: []*wadoInstance{},
+		mutex:     &sync.Mutex{},
+	}
+	err := group.Update(configs)
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// Update changes the group to match the given configurations. Instances that
+// were added are started, removed ones are killed, and the ones with a changed
+// configuration are restarted. If any of the configurations are invalid,
+// an error is returned and the running instances are left untouched.
+func (g *Group) Update(configs []Config) error {
+	if err := ValidateConfigs(configs).Err(); err != nil {
+		return err
+	}
+	sorted, err := SortByDependencies(configs)
+	if err != nil {
+		return err
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	isReload := len(g.instances) > 0
+	current := map[string]int{}
+	for i, key := range groupKeys(g.configs) {
+		current[key] = i
+	}
+
+	// Create the new instances first, so nothing is torn down if any of them fail
+	instances := make([]*wadoInstance, len(sorted))
+	created := []*wadoInstance{}
+	replaced := map[string]bool{}
+	keys := groupKeys(sorted)
+	for i, config := range sorted {
+		if j, exists := current[keys[i]]; exists && reflect.DeepEqual(g.configs[j], config) {
+			instances[i] = g.instances[j]
+			continue
+		}
+
+		instance, err := newInstance(config)
+		if err != nil {
+			killAll(created)
+			return err
+		}
+		instances[i] = instance
+		created = append(created, instance)
+		replaced[keys[i]] = true
+	}
+
+	// Kill the instances that were removed or are being replaced
+	kept := map[*wadoInstance]bool{}
+	for _, instance := range instances {
+		kept[instance] = true
+	}
+	killed := []*wadoInstance{}
+	for _, instance := range g.instances {
+		if !kept[instance] {
+			killed = append(killed, instance)
+		}
+	}
+	killAll(killed)
+
+	// Wire up the dependencies of the new instances, and of the kept ones whose dependencies were replaced
+	byName := map[string]*wadoInstance{}
+	for i, config := range sorted {
+		byName[config.Name] = instances[i]
+	}
+	for i, config := range sorted {
+		deps := []*wadoInstance{}
+		for _, depName := range config.DependsOn {
+			if replaced[keys[i]] || replaced[depName] {
+				deps = append(deps, byName[depName])
+			}
+		}
+		if len(deps) > 0 {
+			startAfterDependencies(instances[i], deps)
+		}
+	}
+
+	g.configs = sorted
+	g.instances = instances
+
+	// Start the new instances without dependencies, once everything is wired up
+	for i, config := range sorted {
+		if !replaced[keys[i]] || len(config.DependsOn) > 0 {
+			continue
+		}
+		if err := instances[i].start(); err != nil {
+			log.Printf("[%v] Could not start: %v\n", instances[i].name, err)
+		}
+	}
+
+	if isReload && (len(created) > 0 || len(killed) > 0) {
+		log.Printf("[Wado] Started %v and stopped %v instances\n", len(created), len(killed))
+	}
+	return nil
+}
+
+// groupKeys returns the keys identifying each configuration between updates. This is
+// the name if there is one, or else the position among the unnamed configurations.
+func groupKeys(configs []Config) []string {
+	keys := []string{}
+	unnamed := 0
+	for _, config := range configs {
+		if config.Name != "" {
+			keys = append(keys, config.Name)
+		} else {
+			keys = append(keys, fmt.Sprintf("#%v", unnamed))
+			unnamed++
+		}
+	}
+	return keys
+}
+
+// startAfterDependencies starts the instance once all the dependencies have
+// succeeded, and restarts it on every success after that
+func startAfterDependencies(instance *wadoInstance, deps []*wadoInstance) {
+	mutex := &sync.Mutex{}
+	waitingFor := map[*wadoInstance]bool{}
+	for _, dep := range deps {
+		if !dep.hasSucceeded() {
+			waitingFor[dep] = true
+		}
+	}
+
+	for _, dep := range deps {
+		dep := dep
+		unregister := dep.onSuccess(func() {
+			mutex.Lock()
+			delete(waitingFor, dep)
+			ready := len(waitingFor) == 0
+			mutex.Unlock()
+
+			if instance.isStarted() {
+				instance.restart(nil)
+			} else if ready {
+				if err := instance.start(); err != nil {
+					log.Printf("[%v] Could not start: %v\n", instance.name, err)
+				}
+			}
+		})
+		instance.onKill(unregister)
+	}
+
+	mutex.Lock()
+	ready := len(waitingFor) == 0
+	mutex.Unlock()
+
+	if ready && !instance.isStarted() {
+		if err := instance.start(); err != nil {
+			log.Printf("[%v] Could not start: %v\n", instance.name, err)
+		}
+	}
+}
+
+// Name returns the names of the instances in the group
+func (g *Group) Name() string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	names := []string{}
+	for _, instance := range g.instances {
+		names = append(names, instance.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Instances returns the instances of the group, in the order of their dependencies
+func (g *Group) Instances() []Instance {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	instances := []Instance{}
+	for _, instance := range g.instances {
+		instances = append(instances, instance)
+	}
+	return instances
+}
+
+// Instance returns the instance with the given name, or nil if there is none
+func (g *Group) Instance(name string) Instance {
+	if instance := g.instance(name); instance != nil {
+		return instance
+	}
+	return nil
+}
+
+func (g *Group) instance(name string) *wadoInstance {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, instance := range g.instances {
+		if instance.name == name {
+			return instance
+		}
+	}
+	return nil
+}
+
+// currentInstances returns a copy of the list of instances
+func (g *Group) currentInstances() []*wadoInstance {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return append([]*wadoInstance{}, g.instances...)
+}
+
+// IsRunning returns true if the main chain of any of the instances is running
+func (g *Group) IsRunning() bool {
+	for _, instance := range g.Instances() {
+		if instance.IsRunning() {
+			return true
+		}
+	}
+	return false
+}
+
+// Restart restarts the main chains of all the instances
+func (g *Group) Restart() {
+	for _, instance := range g.Instances() {
+		instance.Restart()
+	}
+}
+
+// Pause pauses all the instances
+func (g *Group) Pause() {
+	for _, instance := range g.Instances() {
+		instance.Pause()
+	}
+}
+
+// Resume resumes all the instances
+func (g *Group) Resume() {
+	for _, instance := range g.Instances() {
+		instance.Resume()
+	}
+}
+
+// IsPaused returns true if all the instances are paused
+func (g *Group) IsPaused() bool {
+	instances := g.Instances()
+	for _, instance := range instances {
+		if !instance.IsPaused() {
+			return false
+		}
+	}
+	return len(instances) > 0
+}
+
+// Kill kills all the instances in the group
+func (g *Group) Kill() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	killAll(g.instances)
+}
+
+func killAll(instances []*wadoInstance) {
+	wg := sync.WaitGroup{}
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance *wadoInstance) {
+			instance.Kill()
+			wg.Done()
+		}(instance)
+	}
+	wg.Wait()
+}
+
+// SortByDependencies sorts the configurations so every instance comes after
+// the ones it depends on. An error is returned for unknown dependencies and cycles.
+func SortByDependencies(configs []Config) ([]Config, error) {
+	byName := map[string]Config{}
+	for _, config := range configs {
+		if config.Name == "" {
+			continue
+		}
+		if _, exists := byName[config.Name]; exists {
+			return nil, fmt.Errorf("duplicate instance name: %v", config.Name)
+		}
+		byName[config.Name] = config
+	}
+
+	for _, config := range configs {
+		for _, depName := range config.DependsOn {
+			if _, exists := byName[depName]; !exists {
+				return nil, fmt.Errorf("instance %v depends on unknown instance %v", displayName(config), depName)
+			}
+		}
+	}
+
+	sorted := []Config{}
+	done := map[string]bool{}
+	visiting := []string{}
+
+	var visit func(config Config) error
+	visit = func(config Config) error {
+		if config.Name != "" && done[config.Name] {
+			return nil
+		}
+		for i, name := range visiting {
+			if name == config.Name {
+				cycle := append(append([]string{}, visiting[i:]...), config.Name)
+				return fmt.Errorf("dependency cycle: %v", strings.Join(cycle, " -> "))
+			}
+		}
+
+		visiting = append(visiting, config.Name)
+		for _, depName := range config.DependsOn {
+			if err := visit(byName[depName]); err != nil {
+				return err
+			}
+		}
+		visiting = visiting[:len(visiting)-1]
+
+		if config.Name != "" {
+			done[config.Name] = true
+		}
+		sorted = append(sorted, config)
+		return nil
+	}
+
+	for _, config := range configs {
+		if err := visit(config); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// SelectConfigs returns the configurations with the given names, along with all
+// the ones they depend on. All the configurations are returned if no names are given.
+func SelectConfigs(configs []Config, names []string) ([]Config, error) {
+	if len(names) == 0 {
+		return configs, nil
+	}
+
+	byName := map[string]Config{}
+	for _, config := range configs {
+		byName[displayName(config)] = config
+	}
+
+	selected := map[string]bool{}
+	var selectWithDeps func(name string) error
+	selectWithDeps = func(name string) error {
+		config, exists := byName[name]
+		if !exists {
+			return fmt.Errorf("unknown instance: %v", name)
+		}
+		if selected[name] {
+			return nil
+		}
+		selected[name] = true
+		for _, depName := range config.DependsOn {
+			if err := selectWithDeps(depName); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range names {
+		if err := selectWithDeps(name); err != nil {
+			return nil, err
+		}
+	}
+
+	result := []Config{}
+	for _, config := range configs {
+		if selected[displayName(config)] {
+			result = append(result, config)
+		}
+	}
+	return result, nil
+}
+
+func displayName(config Config) string {
+	if config.Name == "" {
+		return "Wado"
+	}
+	return config.Name
+}
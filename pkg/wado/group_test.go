@@ -0,0 +1,186 @@
+package wado
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func configNames(configs []Config) []string {
+	names := []string{}
+	for _, config := range configs {
+		names = append(names, config.Name)
+	}
+	return names
+}
+
+func Test_SortByDependencies(t *testing.T) {
+	sorted, err := SortByDependencies([]Config{
+		{Name: "api", DependsOn: []string{"codegen", "db"}},
+		{Name: "codegen", DependsOn: []string{"db"}},
+		{Name: "db"},
+		{Name: "docs"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db", "codegen", "api", "docs"}, configNames(sorted))
+}
+
+func Test_SortByDependenciesErrors(t *testing.T) {
+	_, err := SortByDependencies([]Config{
+		{Name: "api", DependsOn: []string{"codegen"}},
+		{Name: "codegen", DependsOn: []string{"schema"}},
+		{Name: "schema", DependsOn: []string{"api"}},
+	})
+	assert.EqualError(t, err, "dependency cycle: api -> codegen -> schema -> api")
+
+	_, err = SortByDependencies([]Config{
+		{Name: "api", DependsOn: []string{"codegen"}},
+	})
+	assert.EqualError(t, err, "instance api depends on unknown instance codegen")
+
+	_, err = SortByDependencies([]Config{{Name: "api"}, {Name: "api"}})
+	assert.EqualError(t, err, "duplicate instance name: api")
+}
+
+// chainsFinished is an event writer passing on the instances whose chains finish
+type chainsFinished chan string
+
+func (c chainsFinished) Write(p []byte) (int, error) {
+	var event Event
+	if json.Unmarshal(p, &event) == nil && event.Type == EventChainFinished {
+		select {
+		case c <- event.Instance:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func waitForChainFinished(t *testing.T, finished chainsFinished, instance string) {
+	for {
+		select {
+		case name := <-finished:
+			if name == instance {
+				return
+			}
+		case <-time.After(2 * time.Second):
+			require.Fail(t, "Chain did not finish", instance)
+		}
+	}
+}
+
+func Test_GroupDependencies(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	outFile := filepath.Join(tmpDir, "out.txt")
+
+	echoTo := func(text string) []CmdConfig {
+		return []CmdConfig{{Run: "echo " + text + " >> '" + outFile + "'", Shell: true}}
+	}
+
+	finished := make(chainsFinished, 20)
+	SetEventWriter(finished)
+	defer SetEventWriter(nil)
+
+	group, err := NewGroup([]Config{
+		{Name: "api", DependsOn: []string{"codegen"}, Cmds: echoTo("api")},
+		{Name: "codegen", Cmds: []CmdConfig{{Run: "sleep 0.05"}, echoTo("codegen")[0]}},
+	})
+	require.NoError(t, err)
+	defer group.Kill()
+
+	waitForChainFinished(t, finished, "api")
+	content, err := ioutil.ReadFile(outFile)
+	require.NoError(t, err)
+	assert.Equal(t, "codegen\napi\n", string(content))
+
+	// Rebuilding the dependency triggers the dependent instance
+	codegen := group.instances[0]
+	codegen.restart([]string{"schema.json"})
+
+	waitForChainFinished(t, finished, "api")
+	content, err = ioutil.ReadFile(outFile)
+	require.NoError(t, err)
+	assert.Equal(t, "codegen\napi\ncodegen\napi\n", string(content))
+}
+
+func Test_GroupUpdate(t *testing.T) {
+	group, err := NewGroup([]Config{
+		{Name: "a", Cmds: []CmdConfig{{Run: "echo a"}}},
+		{Name: "b", Cmds: []CmdConfig{{Run: "echo b"}}},
+		{Name: "c", Cmds: []CmdConfig{{Run: "echo c"}}},
+	})
+	require.NoError(t, err)
+	defer group.Kill()
+
+	a, b := group.instances[0], group.instances[1]
+
+	err = group.Update([]Config{
+		{Name: "a", Cmds: []CmdConfig{{Run: "echo a"}}},
+		{Name: "b", Cmds: []CmdConfig{{Run: "echo changed"}}},
+		{Name: "d", Cmds: []CmdConfig{{Run: "echo d"}}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"a", "b", "d"}, configNames(group.configs))
+	assert.True(t, a == group.instances[0], "Unchanged instance should be kept")
+	assert.False(t, b == group.instances[1], "Changed instance should be replaced")
+	assert.True(t, b.killed)
+	assert.True(t, group.instances[2].isStarted())
+
+	// Nothing is touched if the new config is invalid
+	err = group.Update([]Config{
+		{Name: "a", DependsOn: []string{"x"}},
+	})
+	assert.Error(t, err)
+	assert.Len(t, group.instances, 3)
+	assert.False(t, a.killed)
+}
+
+func Test_GroupUpdateUnregistersDependents(t *testing.T) {
+	group, err := NewGroup([]Config{
+		{Name: "api", DependsOn: []string{"codegen"}, Cmds: []CmdConfig{{Run: "echo api"}}},
+		{Name: "codegen", Cmds: []CmdConfig{{Run: "echo codegen"}}},
+	})
+	require.NoError(t, err)
+	defer group.Kill()
+
+	codegen := group.instances[0]
+	for _, run := range []string{"echo changed", "echo again"} {
+		err = group.Update([]Config{
+			{Name: "api", DependsOn: []string{"codegen"}, Cmds: []CmdConfig{{Run: run}}},
+			{Name: "codegen", Cmds: []CmdConfig{{Run: "echo codegen"}}},
+		})
+		require.NoError(t, err)
+	}
+
+	assert.True(t, codegen == group.instances[0], "Unchanged dependency should be kept")
+	codegen.mutex.Lock()
+	defer codegen.mutex.Unlock()
+	assert.Len(t, codegen.successCallbacks, 1, "Only the current dependent should be notified")
+}
+
+func Test_SelectConfigs(t *testing.T) {
+	configs := []Config{
+		{Name: "api", DependsOn: []string{"codegen"}},
+		{Name: "codegen", DependsOn: []string{"db"}},
+		{Name: "db"},
+		{Name: "docs"},
+	}
+
+	selected, err := SelectConfigs(configs, []string{"api"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api", "codegen", "db"}, configNames(selected))
+
+	selected, err = SelectConfigs(configs, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api", "codegen", "db", "docs"}, configNames(selected))
+
+	_, err = SelectConfigs(configs, []string{"web"})
+	assert.EqualError(t, err, "unknown instance: web")
+}
@@ -0,0 +1,293 @@
+package wado
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for the log files, used for the fields left empty in LogConfig
+const (
+	DefaultLogDir      = "logs"
+	DefaultLogMaxSize  = 10 * 1024 * 1024
+	DefaultLogMaxFiles = 3
+)
+
+const logTimestampFormat = "2006-01-02 15:04:05.000 "
+
+// LogConfig holds where to write the output of an instance to, besides the
+// terminal. The file is rotated once it reaches MaxSize, keeping MaxFiles of
+// the old ones as <file>.1, <file>.2 etc. In the config file it can also be
+// given as just true to use the defaults.
+type LogConfig struct {
+	File       string   `yaml:"file,omitempty"`
+	MaxSize    ByteSize `yaml:"maxSize,omitempty"`
+	MaxFiles   int      `yaml:"maxFiles,omitempty"`
+	Timestamps bool     `yaml:"timestamps,omitempty"`
+}
+
+// UnmarshalYAML allows the log to be enabled with just true
+func (c *LogConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		if !enabled {
+			return fmt.Errorf("log can only be set to true, or to the log settings")
+		}
+		*c = LogConfig{}
+		return nil
+	}
+
+	type plainLogConfig LogConfig
+	return unmarshal((*plainLogConfig)(c))
+}
+
+// ByteSize is a number of bytes, which in the config file can be given with a
+// unit, e.g. 500KB or 10MB
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"GB", 1024 * 1024 * 1024},
+	{"MB", 1024 * 1024},
+	{"KB", 1024},
+	{"B", 1},
+}
+
+// ParseByteSize parses a number of bytes with an optional unit
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := ByteSize(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %v", s)
+	}
+	return ByteSize(n * float64(unit)), nil
+}
+
+// UnmarshalYAML allows the size to be given with a unit
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// logFile is a writer appending to a file, which is rotated when it gets too big.
+// The file is opened on the first write, and writes after closing it are dropped.
+type logFile struct {
+	path        string
+	maxSize     int64
+	maxFiles    int
+	timestamps  bool
+	file        *os.File
+	size        int64
+	atLineStart bool
+	failed      bool
+	closed      bool
+	mutex       *sync.Mutex
+}
+
+// The absolute paths of the log files in use, which are never treated as changes,
+// as that would make instances watching them log in a loop
+var logPaths = map[string]int{}
+var logPathsMutex = &sync.Mutex{}
+
+// isLogFile returns true if the path is a log file in use, or one of its rotated files
+func isLogFile(fPath string) bool {
+	if abs, err := filepath.Abs(fPath); err == nil {
+		fPath = abs
+	}
+
+	logPathsMutex.Lock()
+	defer logPathsMutex.Unlock()
+
+	for logPath := range logPaths {
+		if fPath == logPath || strings.HasPrefix(fPath, logPath+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func newLogFile(instance string, config LogConfig) *logFile {
+	path := config.File
+	if path == "" {
+		path = filepath.Join(DefaultLogDir, instance+".log")
+	}
+	l := &logFile{
+		path:        path,
+		maxSize:     int64(config.MaxSize),
+		maxFiles:    config.MaxFiles,
+		timestamps:  config.Timestamps,
+		atLineStart: true,
+		mutex:       &sync.Mutex{},
+	}
+	if l.maxSize <= 0 {
+		l.maxSize = DefaultLogMaxSize
+	}
+	if l.maxFiles <= 0 {
+		l.maxFiles = DefaultLogMaxFiles
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		l.path = abs
+	}
+	logPathsMutex.Lock()
+	logPaths[l.path]++
+	logPathsMutex.Unlock()
+	return l
+}
+
+// Writers returns separate writers for the stdout and stderr of a command, which
+// pass on whole lines, so partial lines of the two are not mixed in the file
+func (l *logFile) Writers() (io.Writer, io.Writer) {
+	return newLineWriter(l.writeLines), newLineWriter(l.writeLines)
+}
+
+func (l *logFile) writeLines(lines [][]byte) error {
+	_, err := l.Write(bytes.Join(lines, nil))
+	return err
+}
+
+// open opens the file for appending, creating its directory if needed
+func (l *logFile) open() error {
+	err := os.MkdirAll(filepath.Dir(l.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// The output still goes to the terminal, so failing to log is not an error for the command
+	if l.closed || l.failed {
+		return len(p), nil
+	}
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			log.Printf("Could not open the log file %v: %v\n", l.path, err)
+			l.failed = true
+			return len(p), nil
+		}
+	}
+
+	out := p
+	if l.timestamps {
+		out = l.addTimestamps(p)
+	}
+
+	if l.size > 0 && l.size+int64(len(out)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("Could not rotate the log file %v: %v\n", l.path, err)
+			l.failed = true
+			return len(p), nil
+		}
+	}
+
+	n, err := l.file.Write(out)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Could not write to the log file %v: %v\n", l.path, err)
+		l.failed = true
+	}
+	return len(p), nil
+}
+
+// addTimestamps adds the current time to the start of every line
+func (l *logFile) addTimestamps(p []byte) []byte {
+	timestamp := []byte(time.Now().Format(logTimestampFormat))
+	buf := &bytes.Buffer{}
+	for len(p) > 0 {
+		if l.atLineStart {
+			buf.Write(timestamp)
+		}
+		end := bytes.IndexByte(p, '\n')
+		if end < 0 {
+			buf.Write(p)
+			l.atLineStart = false
+			break
+		}
+		buf.Write(p[:end+1])
+		p = p[end+1:]
+		l.atLineStart = true
+	}
+	return buf.Bytes()
+}
+
+// rotate moves the current file to <file>.1, shifting the older ones up and
+// dropping the oldest, and starts a new file
+func (l *logFile) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	os.Remove(fmt.Sprintf("%v.%v", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%v.%v", l.path, i), fmt.Sprintf("%v.%v", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the file
+func (l *logFile) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.closed {
+		logPathsMutex.Lock()
+		logPaths[l.path]--
+		if logPaths[l.path] <= 0 {
+			delete(logPaths, l.path)
+		}
+		logPathsMutex.Unlock()
+	}
+
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,132 @@
+package wado
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func Test_LogFileRotation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "logs", "api.log")
+	l := newLogFile("api", LogConfig{File: path, MaxSize: 20, MaxFiles: 2})
+	for _, line := range []string{"first line\n", "second line\n", "third line\n", "fourth line\n"} {
+		_, err := l.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	read := func(path string) string {
+		content, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		return string(content)
+	}
+	assert.Equal(t, "fourth line\n", read(path))
+	assert.Equal(t, "third line\n", read(path+".1"))
+	assert.Equal(t, "second line\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Output after closing is dropped
+	n, err := l.Write([]byte("dropped\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, "fourth line\n", read(path))
+}
+
+func Test_LogFileTimestamps(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "api.log")
+	l := newLogFile("api", LogConfig{File: path, Timestamps: true})
+	l.Write([]byte("one\ntw"))
+	l.Write([]byte("o\nthree\n"))
+	l.Close()
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	timestamp := `^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\.\d{3} `
+	require.Len(t, lines, 3)
+	assert.Regexp(t, regexp.MustCompile(timestamp+"one$"), lines[0])
+	assert.Regexp(t, regexp.MustCompile(timestamp+"two$"), lines[1])
+	assert.Regexp(t, regexp.MustCompile(timestamp+"three$"), lines[2])
+}
+
+func Test_LogFileWriters(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "api.log")
+	l := newLogFile("api", LogConfig{File: path, Timestamps: true})
+	stdout, stderr := l.Writers()
+	stdout.Write([]byte("out "))
+	stderr.Write([]byte("err "))
+	stdout.Write([]byte("line\n"))
+	stderr.Write([]byte("line\n"))
+	l.Close()
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	timestamp := `^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\.\d{3} `
+	require.Len(t, lines, 2)
+	assert.Regexp(t, regexp.MustCompile(timestamp+"out line$"), lines[0])
+	assert.Regexp(t, regexp.MustCompile(timestamp+"err line$"), lines[1])
+}
+
+func Test_LogFileOfFailedInstance(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "api.log")
+	_, err = newInstance(Config{Name: "api", Mode: "sometimes", Log: &LogConfig{File: path}})
+	require.Error(t, err)
+	assert.False(t, isLogFile(path), "The log file of a failed instance should not hide changes")
+}
+
+func Test_LogConfigYAML(t *testing.T) {
+	var config Config
+	require.NoError(t, yaml.Unmarshal([]byte("log: true"), &config))
+	assert.Equal(t, &LogConfig{}, config.Log)
+
+	config = Config{}
+	require.NoError(t, yaml.Unmarshal([]byte("log: {maxSize: 1.5MB, maxFiles: 5}"), &config))
+	assert.Equal(t, &LogConfig{MaxSize: 1536 * 1024, MaxFiles: 5}, config.Log)
+
+	config = Config{}
+	require.NoError(t, yaml.Unmarshal([]byte("log: {maxSize: 2048}"), &config))
+	assert.Equal(t, ByteSize(2048), config.Log.MaxSize)
+
+	assert.Error(t, yaml.Unmarshal([]byte("log: false"), &Config{}))
+	assert.Error(t, yaml.Unmarshal([]byte("log: {maxSize: lots}"), &Config{}))
+}
+
+func Test_LogFileIgnoredAsChange(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "api.log")
+	l := newLogFile("api", LogConfig{File: path})
+	assert.True(t, isLogFile(path))
+	assert.True(t, isLogFile(path+".1"))
+	assert.False(t, isLogFile(filepath.Join(tmpDir, "api.go")))
+
+	l.Close()
+	assert.False(t, isLogFile(path))
+}
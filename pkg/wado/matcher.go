@@ -0,0 +1,111 @@
+package wado
+
+import (
+	"path/filepath"
+	"strings"
+
+	zglob "github.com/mattn/go-zglob"
+)
+
+// globMatcher matches file paths against include and exclude globs. Both are
+// made absolute, so relative globs also match the absolute paths from watchers.
+// An exclude glob matching a directory, like vendor or vendor/**, excludes
+// everything in it.
+type globMatcher struct {
+	includeGlobs []string
+	excludeGlobs []string
+
+	// The globs for directories with everything in them excluded, and for their contents
+	excludeDirGlobs     []string
+	excludeContentGlobs []string
+}
+
+func newGlobMatcher(includeGlobs []string, excludeGlobs []string) (*globMatcher, error) {
+	absInclude, err := absGlobs(includeGlobs)
+	if err != nil {
+		return nil, err
+	}
+	absExclude, err := absGlobs(excludeGlobs)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &globMatcher{
+		includeGlobs: absInclude,
+		excludeGlobs: absExclude,
+	}
+	for _, glob := range absExclude {
+		dirGlob := strings.TrimSuffix(strings.TrimSuffix(glob, "/**/*"), "/**")
+		m.excludeDirGlobs = append(m.excludeDirGlobs, dirGlob)
+		m.excludeContentGlobs = append(m.excludeContentGlobs, dirGlob+"/**/*")
+	}
+	return m, nil
+}
+
+// Match returns true if the path matches any of the include globs and none of the exclude globs
+func (m *globMatcher) Match(fPath string) bool {
+	absPath, err := filepath.Abs(fPath)
+	if err != nil {
+		return false
+	}
+	absPath = filepath.ToSlash(absPath)
+
+	if matchAny(m.excludeGlobs, absPath) || matchAny(m.excludeContentGlobs, absPath) {
+		return false
+	}
+	return matchAny(m.includeGlobs, absPath)
+}
+
+// ExcludesDir returns true if everything in the directory is excluded, so it
+// does not have to be watched at all
+func (m *globMatcher) ExcludesDir(dirPath string) bool {
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		return false
+	}
+	return matchAny(m.excludeDirGlobs, filepath.ToSlash(absPath))
+}
+
+// Filter returns the paths matching the globs
+func (m *globMatcher) Filter(paths []string) []string {
+	result := []string{}
+	for _, fPath := range paths {
+		if m.Match(fPath) {
+			result = append(result, fPath)
+		}
+	}
+	return result
+}
+
+func matchAny(globs []string, fPath string) bool {
+	for _, glob := range globs {
+		if matched, err := zglob.Match(glob, fPath); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveGlobs returns the globs as absolute paths with forward slashes, the
+// way they are matched against changed files
+func ResolveGlobs(globs []string) ([]string, error) {
+	return absGlobs(globs)
+}
+
+func absGlobs(globs []string) ([]string, error) {
+	result := []string{}
+	for _, glob := range globs {
+		abs, err := filepath.Abs(glob)
+		if err != nil {
+			return nil, err
+		}
+		abs = filepath.ToSlash(abs)
+
+		// Make sure the glob is well-formed, as zglob does not report it
+		if _, err := filepath.Match(abs, ""); err != nil {
+			return nil, err
+		}
+		result = append(result, abs)
+	}
+	return result, nil
+}
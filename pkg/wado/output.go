@@ -0,0 +1,72 @@
+package wado
+
+import (
+	"bytes"
+	"sync"
+)
+
+// The amount of output kept for each instance, so it can be shown after the fact
+const maxRecentOutput = 64 * 1024
+
+// recentOutput is a writer that keeps the latest output of an instance, and
+// passes everything written on to the subscribers following it
+type recentOutput struct {
+	buf         []byte
+	subscribers map[chan []byte]bool
+	mutex       *sync.Mutex
+}
+
+func newRecentOutput() *recentOutput {
+	return &recentOutput{
+		buf:         []byte{},
+		subscribers: map[chan []byte]bool{},
+		mutex:       &sync.Mutex{},
+	}
+}
+
+func (o *recentOutput) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.buf = append(o.buf, p...)
+	if len(o.buf) > maxRecentOutput {
+		// Drop the oldest output, starting from a whole line if possible
+		o.buf = o.buf[len(o.buf)-maxRecentOutput:]
+		if i := bytes.IndexByte(o.buf, '\n'); i >= 0 {
+			o.buf = o.buf[i+1:]
+		}
+		o.buf = append([]byte{}, o.buf...)
+	}
+
+	for ch := range o.subscribers {
+		// Slow subscribers miss output rather than blocking the commands
+		select {
+		case ch <- append([]byte{}, p...):
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// Recent returns a copy of the latest output
+func (o *recentOutput) Recent() []byte {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]byte{}, o.buf...)
+}
+
+// Follow returns the latest output, and a channel receiving everything written
+// after that until unsubscribe is called
+func (o *recentOutput) Follow() (recent []byte, output <-chan []byte, unsubscribe func()) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	ch := make(chan []byte, 256)
+	o.subscribers[ch] = true
+	unsubscribe = func() {
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+		delete(o.subscribers, ch)
+	}
+	return append([]byte{}, o.buf...), ch, unsubscribe
+}
@@ -0,0 +1,186 @@
+package wado
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mktange/wado/internal/pkg/util"
+)
+
+// How long a line without a newline, e.g. a prompt, is held back before it is written anyway
+const partialLineTimeout = 200 * time.Millisecond
+
+// Colors of the instance names, picked by the name so an instance always gets the same
+var labelColors = []string{"36", "33", "32", "35", "34", "96", "93", "92", "95", "94"}
+
+// The output of all the instances, written to stdout and stderr
+var stdOutputMux = newOutputMux(os.Stdout, os.Stderr, useColors(os.Stdout))
+
+// outputMux writes the output of many commands to the same output, a whole
+// line at a time, with each line prefixed by the command it came from
+type outputMux struct {
+	out        io.Writer
+	errOut     io.Writer
+	colored    bool
+	labelWidth int
+	mutex      *sync.Mutex
+}
+
+func newOutputMux(out io.Writer, errOut io.Writer, colored bool) *outputMux {
+	return &outputMux{
+		out:     out,
+		errOut:  errOut,
+		colored: colored,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// SetOutput sets where the output of all the instances is written to, instead
+// of stdout and stderr
+func SetOutput(stdout io.Writer, stderr io.Writer) {
+	stdOutputMux.mutex.Lock()
+	defer stdOutputMux.mutex.Unlock()
+	stdOutputMux.out = stdout
+	stdOutputMux.errOut = stderr
+	if file, ok := stdout.(*os.File); ok {
+		stdOutputMux.colored = useColors(file)
+	} else {
+		stdOutputMux.colored = false
+	}
+}
+
+func useColors(file *os.File) bool {
+	return os.Getenv("NO_COLOR") == "" && util.IsTerminal(int(file.Fd()))
+}
+
+// Writers returns the writers for the stdout and stderr of a command, which
+// are labeled with the instance and step name
+func (o *outputMux) Writers(instance string, step string) (io.Writer, io.Writer) {
+	label := instance
+	if step != "" {
+		label += ":" + step
+	}
+	color := labelColors[hashString(instance)%uint32(len(labelColors))]
+
+	o.mutex.Lock()
+	if len(label) > o.labelWidth {
+		o.labelWidth = len(label)
+	}
+	o.mutex.Unlock()
+
+	stdout := newLineWriter(func(lines [][]byte) error {
+		return o.writeLines(label, color, false, lines)
+	})
+	stderr := newLineWriter(func(lines [][]byte) error {
+		return o.writeLines(label, color, true, lines)
+	})
+	return stdout, stderr
+}
+
+// writeLines writes the lines together, so lines from other commands end up before or after them
+func (o *outputMux) writeLines(label string, color string, isErr bool, lines [][]byte) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	padding := strings.Repeat(" ", o.labelWidth-len(label))
+	separator := "|"
+	if isErr {
+		separator = "!"
+	}
+	var prefix string
+	if o.colored {
+		if isErr {
+			separator = "\033[1;31m" + separator + "\033[0m"
+		}
+		prefix = fmt.Sprintf("\033[%vm%v\033[0m%v %v ", color, label, padding, separator)
+	} else {
+		prefix = fmt.Sprintf("%v%v %v ", label, padding, separator)
+	}
+
+	buf := &bytes.Buffer{}
+	for _, line := range lines {
+		buf.WriteString(prefix)
+		buf.Write(line)
+	}
+
+	out := o.out
+	if isErr {
+		out = o.errOut
+	}
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// lineWriter collects the output of a command into lines, and passes them on a
+// whole line at a time
+type lineWriter struct {
+	writeLines func(lines [][]byte) error
+	line       []byte
+	timer      *time.Timer
+	mutex      *sync.Mutex
+}
+
+func newLineWriter(writeLines func(lines [][]byte) error) *lineWriter {
+	return &lineWriter{
+		writeLines: writeLines,
+		line:       []byte{},
+		mutex:      &sync.Mutex{},
+	}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.line = append(w.line, p...)
+	lines := [][]byte{}
+	for {
+		end := bytes.IndexByte(w.line, '\n')
+		if end < 0 {
+			break
+		}
+		lines = append(lines, w.line[:end+1])
+		w.line = w.line[end+1:]
+	}
+	w.line = append([]byte{}, w.line...)
+
+	if len(w.line) > 0 {
+		if w.timer == nil {
+			w.timer = time.AfterFunc(partialLineTimeout, w.flushPartialLine)
+		} else {
+			w.timer.Reset(partialLineTimeout)
+		}
+	}
+
+	if len(lines) > 0 {
+		if err := w.writeLines(lines); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flushPartialLine writes the line held back as if it was a whole line
+func (w *lineWriter) flushPartialLine() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.line) == 0 {
+		return
+	}
+	line := append(w.line, '\n')
+	w.line = []byte{}
+	w.writeLines([][]byte{line})
+}
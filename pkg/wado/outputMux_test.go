@@ -0,0 +1,77 @@
+package wado
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mktange/wado/internal/pkg/syncimpls"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OutputMux(t *testing.T) {
+	out := syncimpls.NewSyncBuffer()
+	errOut := syncimpls.NewSyncBuffer()
+	mux := newOutputMux(out, errOut, false)
+
+	apiOut, apiErr := mux.Writers("api", "go")
+	webOut, _ := mux.Writers("web", "npm")
+
+	apiOut.Write([]byte("building"))
+	webOut.Write([]byte("serving\n"))
+	apiOut.Write([]byte("...\ndone\n"))
+	apiErr.Write([]byte("warning\n"))
+
+	assert.Equal(t, "web:npm | serving\napi:go  | building...\napi:go  | done\n", out.String())
+	assert.Equal(t, "api:go  ! warning\n", errOut.String())
+}
+
+func Test_OutputMuxWholeLines(t *testing.T) {
+	out := &bytes.Buffer{}
+	mux := newOutputMux(out, out, false)
+
+	wg := sync.WaitGroup{}
+	for _, name := range []string{"a", "b", "c"} {
+		writer, _ := mux.Writers(name, "")
+		wg.Add(1)
+		go func(name string, writer interface{ Write([]byte) (int, error) }) {
+			for i := 0; i < 100; i++ {
+				writer.Write([]byte(name + name))
+				writer.Write([]byte(name + "\n"))
+			}
+			wg.Done()
+		}(name, writer)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Len(t, lines, 300)
+	for _, line := range lines {
+		name := line[:1]
+		assert.Equal(t, name+" | "+name+name+name, line)
+	}
+}
+
+func Test_OutputMuxPartialLine(t *testing.T) {
+	out := syncimpls.NewSyncBuffer()
+	mux := newOutputMux(out, out, false)
+	writer, _ := mux.Writers("api", "")
+
+	writer.Write([]byte("Password: "))
+	assert.Equal(t, "", out.String())
+	<-time.After(2 * partialLineTimeout)
+	assert.Equal(t, "api | Password: \n", out.String())
+}
+
+func Test_OutputMuxColors(t *testing.T) {
+	out := &bytes.Buffer{}
+	mux := newOutputMux(out, out, true)
+	stdout, stderr := mux.Writers("api", "")
+	stdout.Write([]byte("out\n"))
+	stderr.Write([]byte("err\n"))
+
+	color := labelColors[hashString("api")%uint32(len(labelColors))]
+	assert.Equal(t, "\033["+color+"mapi\033[0m | out\n\033["+color+"mapi\033[0m \033[1;31m!\033[0m err\n", out.String())
+}
@@ -0,0 +1,31 @@
+package wado
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RecentOutput(t *testing.T) {
+	output := newRecentOutput()
+	output.Write([]byte("hello\n"))
+
+	recent, ch, unsubscribe := output.Follow()
+	assert.Equal(t, "hello\n", string(recent))
+
+	output.Write([]byte("world\n"))
+	assert.Equal(t, "world\n", string(<-ch))
+	assert.Equal(t, "hello\nworld\n", string(output.Recent()))
+
+	// Only the latest output is kept, starting from a whole line
+	unsubscribe()
+	line := strings.Repeat("x", 99) + "\n"
+	for i := 0; i < 1000; i++ {
+		output.Write([]byte(line))
+	}
+	recent = output.Recent()
+	assert.True(t, len(recent) <= maxRecentOutput)
+	assert.Equal(t, 0, len(recent)%len(line))
+	assert.Len(t, ch, 0)
+}
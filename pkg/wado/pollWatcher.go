@@ -1,27 +1,80 @@
 package wado
 
 import (
-	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
-	zglob "github.com/mattn/go-zglob"
+	"github.com/mattn/go-zglob/fastwalk"
+	"github.com/mktange/wado/internal/pkg/ignore"
 	"github.com/mktange/wado/internal/pkg/syncimpls"
 	"github.com/mktange/wado/internal/pkg/util"
 )
 
+// PollConfig holds the intervals used by the poll watcher. With adaptive
+// polling the intervals grow while no changes are seen, up to MaxInterval,
+// and drop back to the configured ones as soon as a change is detected.
+type PollConfig struct {
+	Interval     time.Duration `yaml:"interval,omitempty"`
+	GlobInterval time.Duration `yaml:"globInterval,omitempty"`
+	Adaptive     bool          `yaml:"adaptive,omitempty"`
+	MaxInterval  time.Duration `yaml:"maxInterval,omitempty"`
+}
+
+// UnmarshalYAML reads intervals given as plain numbers as milliseconds, like minDelay
+func (c *PollConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainPollConfig PollConfig
+	if err := unmarshal((*plainPollConfig)(c)); err != nil {
+		return err
+	}
+
+	return unmarshalMilliseconds(unmarshal, map[string]*time.Duration{
+		"interval":     &c.Interval,
+		"globInterval": &c.GlobInterval,
+		"maxInterval":  &c.MaxInterval,
+	})
+}
+
+// Default poll intervals, used for the fields left empty in PollConfig
+const (
+	DefaultPollInterval     = 300 * time.Millisecond
+	DefaultPollGlobInterval = 1500 * time.Millisecond
+	DefaultPollMaxInterval  = 5 * time.Second
+)
+
+// Adaptive polling adds one adaptiveIdleFactor-th of the idle time to the intervals
+const adaptiveIdleFactor = 10
+
+// pollWatcher polls the files matching its globs. More globs can be added to it
+// after it is created, which is how it is shared by instances.
 type pollWatcher struct {
-	includeGlobs []string
-	excludeGlobs []string
-	changeChans  []chan string
+	globs       []*pollGlobs
+	globLock    *sync.Mutex
+	changeChans []chan string
+	pollConfig  PollConfig
+	ignorer     *ignore.Matcher
 
 	watchedFiles *syncimpls.MapStringFileStats
 	done         chan bool
 
+	lastActivity time.Time
+	activityLock *sync.Mutex
+
+	triggers      map[string]bool
 	callbackFuncs []func(string)
+	opCallbacks   []func(string, string)
 	callbackLock  *sync.Mutex
 }
 
+// pollGlobs are the include globs added to the watcher together, which are
+// removed together as well
+type pollGlobs struct {
+	includeGlobs []string
+	matcher      *globMatcher
+}
+
 func (watcher *pollWatcher) FileCount() int {
 	return watcher.watchedFiles.Size()
 }
@@ -44,59 +97,207 @@ func (watcher *pollWatcher) AddCallback(cb func(string)) {
 	watcher.callbackFuncs = append(watcher.callbackFuncs, cb)
 }
 
+// addOpCallback adds a callback getting every kind of change, along with the kind
+func (watcher *pollWatcher) addOpCallback(cb func(string, string)) {
+	watcher.callbackLock.Lock()
+	defer watcher.callbackLock.Unlock()
+	watcher.opCallbacks = append(watcher.opCallbacks, cb)
+}
+
 // NewPollWatcher creates a new watcher based on the given configurations using polling.
-// Changes are posted on the channel that can be gotten with GetChannel()
-func NewPollWatcher(includeGlobs []string, excludeGlobs []string) (Watcher, error) {
+// Changes are posted on the channel that can be gotten with GetChannel(), for
+// the default triggers. Renamed files are seen as removed.
+// Directories ignored by .wadoignore files, and with gitIgnore also by .gitignore
+// files, are never walked.
+func NewPollWatcher(includeGlobs []string, excludeGlobs []string, gitIgnore bool, pollConfig PollConfig) (Watcher, error) {
+	watcher := newPollWatcher(gitIgnore, pollConfig)
+	_, err := watcher.addGlobs(includeGlobs, excludeGlobs)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// newPollWatcher creates a watcher without any globs, polling nothing yet
+func newPollWatcher(gitIgnore bool, pollConfig PollConfig) *pollWatcher {
+	if pollConfig.Interval <= 0 {
+		pollConfig.Interval = DefaultPollInterval
+	}
+	if pollConfig.GlobInterval <= 0 {
+		pollConfig.GlobInterval = DefaultPollGlobInterval
+	}
+	if pollConfig.MaxInterval <= 0 {
+		pollConfig.MaxInterval = DefaultPollMaxInterval
+	}
+
 	watcher := &pollWatcher{
-		includeGlobs: includeGlobs,
-		excludeGlobs: excludeGlobs,
-		changeChans:  []chan string{},
-		done:         make(chan bool, 10),
+		globs:       []*pollGlobs{},
+		globLock:    &sync.Mutex{},
+		changeChans: []chan string{},
+		pollConfig:  pollConfig,
+		ignorer:     newIgnoreMatcher(gitIgnore),
+		done:        make(chan bool, 10),
+
+		lastActivity: time.Now(),
+		activityLock: &sync.Mutex{},
 
 		watchedFiles:  syncimpls.NewMapStringFileStats(),
 		callbackFuncs: []func(string){},
+		opCallbacks:   []func(string, string){},
 		callbackLock:  &sync.Mutex{},
 	}
+	watcher.triggers, _ = triggerSet(nil)
 
-	watcher.addAllFromGlobs(false)
-	go watcher.checkFiles(300)
-	go watcher.checkGlobs(1500)
+	go watcher.checkFiles(pollConfig.Interval)
+	go watcher.checkGlobs(pollConfig.GlobInterval)
+	return watcher
+}
 
-	return watcher, nil
+// addGlobs starts polling the files matching the include globs, besides what is
+// already polled. The exclude globs are left to the receivers of the changes.
+// It returns a function removing the globs again.
+func (watcher *pollWatcher) addGlobs(includeGlobs []string, excludeGlobs []string) (func(), error) {
+	matcher, err := newGlobMatcher(includeGlobs, nil)
+	if err != nil {
+		return nil, err
+	}
+	globs := &pollGlobs{includeGlobs: includeGlobs, matcher: matcher}
+
+	// The files found now are not changes, so they are added before the globs are
+	// checked in the background
+	watcher.addAllFromGlobs(includeGlobs, false)
+
+	watcher.globLock.Lock()
+	watcher.globs = append(watcher.globs, globs)
+	watcher.globLock.Unlock()
+	return func() { watcher.removeGlobs(globs) }, nil
 }
 
-func (watcher *pollWatcher) addAllFromGlobs(triggerChange bool) {
-	for _, glob := range watcher.includeGlobs {
-		files, err := zglob.Glob(glob)
+// removeGlobs removes globs added before, and stops polling the files that none
+// of the remaining globs match
+func (watcher *pollWatcher) removeGlobs(globs *pollGlobs) {
+	watcher.globLock.Lock()
+	for i, g := range watcher.globs {
+		if g == globs {
+			watcher.globs = append(watcher.globs[:i:i], watcher.globs[i+1:]...)
+			break
+		}
+	}
+	remaining := append([]*pollGlobs{}, watcher.globs...)
+	watcher.globLock.Unlock()
+
+	for fPath := range watcher.watchedFiles.Range() {
+		matched := false
+		for _, g := range remaining {
+			matched = matched || g.matcher.Match(fPath)
+		}
+		if !matched {
+			watcher.watchedFiles.Delete(fPath)
+		}
+	}
+}
+
+// watchedPaths returns the paths of all the polled files
+func (watcher *pollWatcher) watchedPaths() []string {
+	paths := []string{}
+	for fPath := range watcher.watchedFiles.Range() {
+		paths = append(paths, fPath)
+	}
+	return paths
+}
+
+func (watcher *pollWatcher) addAllFromGlobs(globs []string, triggerChange bool) {
+	for _, glob := range globs {
+		files, err := globFiles(glob, watcher.ignorer)
 		if err != nil {
-			log.Println("Error:", err)
+			watcherError("Error:", glob, err)
 			continue
 		}
 
 		for _, file := range files {
 			if _, ok := watcher.watchedFiles.Load(file); ok == false {
+				if watcher.ignorer.Ignored(file, false) {
+					continue
+				}
+				if fi, err := os.Stat(file); err == nil && (fi.IsDir() || util.IsSpecialFile(fi.Mode())) {
+					continue
+				}
 				fs, err := util.GetFileStats(file)
 				if err != nil {
-					log.Println("Error:", err)
+					watcherError("Error:", file, err)
 					continue
 				}
 				watcher.watchedFiles.Store(file, fs)
 				if triggerChange {
-					watcher.changeDetected(file)
+					watcher.changeDetected(file, TriggerCreate)
 				}
 			}
 		}
 	}
 }
 
+// globFiles returns the files matching the glob like zglob.Glob, but without
+// walking the directories that are ignored or that cannot contain matches
+func globFiles(glob string, ignorer *ignore.Matcher) ([]string, error) {
+	if !strings.ContainsAny(glob, "*?[{") {
+		if _, err := os.Stat(glob); err != nil {
+			return nil, err
+		}
+		return []string{glob}, nil
+	}
+
+	absGlob, err := absGlobs([]string{glob})
+	if err != nil {
+		return nil, err
+	}
+	root := util.GetLowestDirToWatch(glob)
+	dirRegex := util.GetCouldDirMatchRegex(glob)
+
+	files := []string{}
+	filesLock := &sync.Mutex{}
+	err = fastwalk.FastWalk(root, func(fPath string, typ os.FileMode) error {
+		if typ.IsDir() {
+			if fPath == root {
+				return nil
+			}
+			if couldMatch, err := util.CouldDirMatch(dirRegex, fPath); err != nil || !couldMatch || ignorer.IgnoredDir(fPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fPath = filepath.ToSlash(filepath.Clean(fPath))
+		absPath, err := filepath.Abs(fPath)
+		if err != nil || !matchAny(absGlob, filepath.ToSlash(absPath)) {
+			return nil
+		}
+		filesLock.Lock()
+		files = append(files, fPath)
+		filesLock.Unlock()
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return files, err
+}
+
 func (watcher *pollWatcher) checkGlobs(delay time.Duration) {
 	for {
-		watcher.addAllFromGlobs(true)
+		watcher.globLock.Lock()
+		globs := []string{}
+		for _, g := range watcher.globs {
+			globs = append(globs, g.includeGlobs...)
+		}
+		watcher.globLock.Unlock()
+		watcher.ignorer.Refresh()
+		watcher.addAllFromGlobs(globs, true)
 
 		select {
 		case <-watcher.done:
 			return
-		case <-time.After(delay * time.Millisecond):
+		case <-time.After(watcher.nextDelay(delay)):
 		}
 	}
 }
@@ -106,7 +307,7 @@ func (watcher *pollWatcher) checkFiles(delay time.Duration) {
 		for file, fs := range watcher.watchedFiles.Range() {
 			newFs, changed, err := util.HasChanged(file, fs)
 			if err != nil {
-				log.Println("Error:", err)
+				watcherError("Error:", file, err)
 			}
 
 			if changed {
@@ -114,20 +315,54 @@ func (watcher *pollWatcher) checkFiles(delay time.Duration) {
 					watcher.watchedFiles.Delete(file)
 				} else {
 					watcher.watchedFiles.Store(file, newFs)
-					watcher.changeDetected(file)
 				}
+				watcher.changeDetected(file, changeOf(fs, newFs))
 			}
 		}
 
 		select {
 		case <-watcher.done:
 			return
-		case <-time.After(delay * time.Millisecond):
+		case <-time.After(watcher.nextDelay(delay)):
 		}
 	}
 }
 
-func (watcher *pollWatcher) changeDetected(filePath string) {
+// nextDelay returns how long to wait before the next check, given the base interval
+func (watcher *pollWatcher) nextDelay(interval time.Duration) time.Duration {
+	if !watcher.pollConfig.Adaptive {
+		return interval
+	}
+
+	watcher.activityLock.Lock()
+	idle := time.Since(watcher.lastActivity)
+	watcher.activityLock.Unlock()
+
+	delay := interval + idle/adaptiveIdleFactor
+	if delay > watcher.pollConfig.MaxInterval {
+		delay = watcher.pollConfig.MaxInterval
+	}
+	if delay < interval {
+		delay = interval
+	}
+	return delay
+}
+
+func (watcher *pollWatcher) changeDetected(filePath string, op string) {
+	watcher.activityLock.Lock()
+	watcher.lastActivity = time.Now()
+	watcher.activityLock.Unlock()
+
+	watcher.callbackLock.Lock()
+	defer watcher.callbackLock.Unlock()
+
+	for _, cb := range watcher.opCallbacks {
+		go cb(filePath, op)
+	}
+	if !watcher.triggers[op] {
+		return
+	}
+
 	for _, cb := range watcher.callbackFuncs {
 		go cb(filePath)
 	}
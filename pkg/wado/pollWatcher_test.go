@@ -0,0 +1,100 @@
+package wado
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mktange/wado/internal/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func Test_PollWatch(t *testing.T) {
+	// Create tmp dir and files to watch
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	aGoFile, err := os.Create(filepath.Join(tmpDir, "a.go"))
+	require.NoError(t, err)
+
+	glob := filepath.Join(tmpDir, "**", "*.go")
+
+	// Setup watcher
+	watcher, err := NewPollWatcher([]string{glob}, []string{}, false, PollConfig{
+		Interval: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	changeChan := watcher.CreateChangeChannel()
+	assert.Equal(t, 1, watcher.FileCount())
+
+	// Make a change to a watched file, making sure the mod time moves
+	<-time.After(20 * time.Millisecond)
+	_, err = aGoFile.WriteString("Foo")
+	require.NoError(t, err)
+	err = aGoFile.Sync()
+	require.NoError(t, err)
+
+	changeHappened := util.WaitForMessage(t, changeChan)
+	assert.True(t, changeHappened, "Change did not appear on channel")
+}
+
+func setLastActivity(pw *pollWatcher, lastActivity time.Time) {
+	pw.activityLock.Lock()
+	pw.lastActivity = lastActivity
+	pw.activityLock.Unlock()
+}
+
+func Test_PollAdaptiveDelay(t *testing.T) {
+	watcher, err := NewPollWatcher([]string{}, []string{}, false, PollConfig{
+		Interval:    100 * time.Millisecond,
+		Adaptive:    true,
+		MaxInterval: time.Second,
+	})
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	pw := watcher.(*pollWatcher)
+	assert.InDelta(t, 100*time.Millisecond, pw.nextDelay(100*time.Millisecond), float64(5*time.Millisecond))
+
+	setLastActivity(pw, time.Now().Add(-5*time.Second))
+	assert.InDelta(t, 600*time.Millisecond, pw.nextDelay(100*time.Millisecond), float64(5*time.Millisecond))
+
+	setLastActivity(pw, time.Now().Add(-time.Hour))
+	assert.Equal(t, time.Second, pw.nextDelay(100*time.Millisecond))
+
+	pw.changeDetected("a.go", TriggerWrite)
+	assert.InDelta(t, 100*time.Millisecond, pw.nextDelay(100*time.Millisecond), float64(5*time.Millisecond))
+}
+
+func Test_PollConfigYAML(t *testing.T) {
+	var config Config
+	require.NoError(t, yaml.Unmarshal([]byte("poll: {interval: 300, globInterval: 2s, adaptive: true}"), &config))
+	assert.Equal(t, PollConfig{Interval: 300 * time.Millisecond, GlobInterval: 2 * time.Second, Adaptive: true}, config.Poll)
+
+	assert.Error(t, yaml.Unmarshal([]byte("poll: {interval: often}"), &Config{}))
+}
+
+func Test_PollWatchSkipsDirsAndSockets(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), os.ModePerm))
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "logs"), os.ModePerm))
+	listener, err := net.Listen("unix", filepath.Join(tmpDir, "wado.sock"))
+	require.NoError(t, err)
+	defer listener.Close()
+
+	watcher, err := NewPollWatcher([]string{filepath.Join(tmpDir, "*")}, []string{}, false, PollConfig{})
+	require.NoError(t, err)
+	defer watcher.Close()
+	assert.Equal(t, 1, watcher.FileCount())
+}
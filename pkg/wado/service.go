@@ -0,0 +1,194 @@
+package wado
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// The kinds of commands in a chain. Tasks have to finish before the chain moves
+// on, while services keep running and only have to become ready.
+const (
+	KindTask    = "task"
+	KindService = "service"
+)
+
+// How long a service gets to become ready if no timeout is configured,
+// and how often the TCP and HTTP probes are tried
+const (
+	defaultReadyTimeout = time.Minute
+	readyProbeInterval  = 100 * time.Millisecond
+)
+
+// ReadyConfig holds the probes deciding when a service is ready. All the given
+// probes have to pass, and a service without probes is ready once it has started.
+type ReadyConfig struct {
+	Log     string        `yaml:"log,omitempty"`
+	TCP     string        `yaml:"tcp,omitempty"`
+	HTTP    string        `yaml:"http,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// UnmarshalYAML reads a timeout given as a plain number as milliseconds
+func (c *ReadyConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainReadyConfig ReadyConfig
+	if err := unmarshal((*plainReadyConfig)(c)); err != nil {
+		return err
+	}
+	return unmarshalMilliseconds(unmarshal, map[string]*time.Duration{"timeout": &c.Timeout})
+}
+
+// IsService returns true if the command is a long-running service
+func (c CmdConfig) IsService() bool {
+	return c.Kind == KindService
+}
+
+func (c CmdConfig) validateKind() error {
+	switch c.Kind {
+	case "", KindTask:
+		if c.Ready != nil {
+			return fmt.Errorf("ready probes are only supported for services: %v", c.Run)
+		}
+	case KindService:
+		if c.Ready != nil && c.Ready.Log != "" {
+			if _, err := regexp.Compile(c.Ready.Log); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown command kind: %v", c.Kind)
+	}
+	return nil
+}
+
+// lineMatchWriter passes everything on to the writer, and closes the matched
+// channel the first time a line of the output matches the regex
+type lineMatchWriter struct {
+	writer      io.Writer
+	regex       *regexp.Regexp
+	matched     chan bool
+	closeSignal *sync.Once
+	line        []byte
+	mutex       *sync.Mutex
+}
+
+func newLineMatchWriter(writer io.Writer, regex *regexp.Regexp) *lineMatchWriter {
+	return &lineMatchWriter{
+		writer:      writer,
+		regex:       regex,
+		matched:     make(chan bool),
+		closeSignal: &sync.Once{},
+		line:        []byte{},
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// withWriter returns a writer for another output of the same command, e.g.
+// stderr, which closes the same matched channel
+func (w *lineMatchWriter) withWriter(writer io.Writer) *lineMatchWriter {
+	return &lineMatchWriter{
+		writer:      writer,
+		regex:       w.regex,
+		matched:     w.matched,
+		closeSignal: w.closeSignal,
+		line:        []byte{},
+		mutex:       &sync.Mutex{},
+	}
+}
+
+func (w *lineMatchWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	if w.regex != nil {
+		w.line = append(w.line, p...)
+		for {
+			end := bytes.IndexByte(w.line, '\n')
+			if end < 0 {
+				break
+			}
+			if w.regex.Match(w.line[:end]) {
+				w.closeSignal.Do(func() { close(w.matched) })
+				w.regex = nil
+				w.line = nil
+				break
+			}
+			w.line = w.line[end+1:]
+		}
+	}
+	w.mutex.Unlock()
+
+	return w.writer.Write(p)
+}
+
+// WaitReady waits for a started service to pass its ready probes. An error is
+// returned if the service exits or does not become ready in time.
+func (r *cmdRun) WaitReady() error {
+	ready := ReadyConfig{}
+	if r.config.Ready != nil {
+		ready = *r.config.Ready
+	}
+	if ready.Timeout <= 0 {
+		ready.Timeout = defaultReadyTimeout
+	}
+
+	r.mutex.Lock()
+	done := r.done
+	logMatched := r.logMatched
+	r.mutex.Unlock()
+
+	timeout := time.After(ready.Timeout)
+	probeTick := time.NewTicker(readyProbeInterval)
+	defer probeTick.Stop()
+
+	hasLogMatched := logMatched == nil
+	for {
+		if hasLogMatched && probeTCP(ready.TCP) && probeHTTP(ready.HTTP) {
+			return nil
+		}
+
+		select {
+		case <-logMatched:
+			hasLogMatched = true
+			logMatched = nil
+		case <-done:
+			if err := r.getErr(); err != nil {
+				return err
+			}
+			return fmt.Errorf("exited before being ready")
+		case <-timeout:
+			return fmt.Errorf("not ready after %v", ready.Timeout)
+		case <-probeTick.C:
+		}
+	}
+}
+
+// probeTCP returns true if a connection can be made to the address, or if no address is given
+func probeTCP(address string) bool {
+	if address == "" {
+		return true
+	}
+	conn, err := net.DialTimeout("tcp", address, readyProbeInterval)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// probeHTTP returns true if the URL responds with 200 OK, or if no URL is given
+func probeHTTP(url string) bool {
+	if url == "" {
+		return true
+	}
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
@@ -0,0 +1,198 @@
+package wado
+
+import (
+	"fmt"
+	"sync"
+)
+
+// globWatcher is a watcher that more globs can be added to after it is created
+type globWatcher interface {
+	opWatcher
+	addGlobs(includeGlobs []string, excludeGlobs []string) (removeGlobs func(), err error)
+	watchedPaths() []string
+}
+
+// The watchers shared by all instances, by their kind and settings. Every file
+// is scanned and hashed once, no matter how many instances are watching it.
+var sharedWatchers = map[string]*sharedWatcher{}
+var sharedWatchersLock = &sync.Mutex{}
+
+type sharedWatcher struct {
+	key           string
+	watcher       globWatcher
+	subscriptions []*watchSubscription
+	mutex         *sync.Mutex
+}
+
+// watchSubscription is the watcher of a single instance, which gets the changes
+// from a shared watcher that match its own globs and triggers
+type watchSubscription struct {
+	shared        *sharedWatcher
+	removeGlobs   func()
+	matcher       *globMatcher
+	triggers      map[string]bool
+	changeChans   []chan string
+	callbackFuncs []func(string, string)
+	callbackLock  *sync.Mutex
+	closeOnce     *sync.Once
+}
+
+// newSharedWatcher returns a watcher of the given kind for the globs, which is
+// backed by the watcher shared by everything watching with the same settings
+func newSharedWatcher(kind string, includeGlobs []string, excludeGlobs []string, gitIgnore bool, triggers []string, pollConfig PollConfig) (Watcher, error) {
+	matcher, err := newGlobMatcher(includeGlobs, excludeGlobs)
+	if err != nil {
+		return nil, err
+	}
+	triggerKinds, err := triggerSet(triggers)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%v gitignore=%v", kind, gitIgnore)
+	if kind == WatcherPoll {
+		key += fmt.Sprintf(" %+v", pollConfig)
+	}
+
+	sharedWatchersLock.Lock()
+	defer sharedWatchersLock.Unlock()
+
+	shared, exists := sharedWatchers[key]
+	if !exists {
+		var watcher globWatcher
+		if kind == WatcherPoll {
+			watcher = newPollWatcher(gitIgnore, pollConfig)
+		} else {
+			watcher, err = newFsNotifyWatcher(gitIgnore)
+			if err != nil {
+				return nil, err
+			}
+		}
+		shared = &sharedWatcher{
+			key:           key,
+			watcher:       watcher,
+			subscriptions: []*watchSubscription{},
+			mutex:         &sync.Mutex{},
+		}
+		watcher.addOpCallback(shared.changeDetected)
+	}
+
+	removeGlobs, err := shared.watcher.addGlobs(includeGlobs, excludeGlobs)
+	if err != nil {
+		if !exists {
+			shared.watcher.Close()
+		}
+		return nil, err
+	}
+
+	subscription := &watchSubscription{
+		shared:        shared,
+		removeGlobs:   removeGlobs,
+		matcher:       matcher,
+		triggers:      triggerKinds,
+		changeChans:   []chan string{},
+		callbackFuncs: []func(string, string){},
+		callbackLock:  &sync.Mutex{},
+		closeOnce:     &sync.Once{},
+	}
+	shared.mutex.Lock()
+	shared.subscriptions = append(shared.subscriptions, subscription)
+	shared.mutex.Unlock()
+	sharedWatchers[key] = shared
+	return subscription, nil
+}
+
+// changeDetected passes the change on to the subscriptions whose globs and triggers match it
+func (shared *sharedWatcher) changeDetected(filePath string, op string) {
+	shared.mutex.Lock()
+	subscriptions := append([]*watchSubscription{}, shared.subscriptions...)
+	shared.mutex.Unlock()
+
+	for _, subscription := range subscriptions {
+		if subscription.triggers[op] && subscription.matcher.Match(filePath) {
+			subscription.changeDetected(filePath, op)
+		}
+	}
+}
+
+// unsubscribe removes the subscription along with its globs, closing the shared
+// watcher when it was the last one
+func (shared *sharedWatcher) unsubscribe(subscription *watchSubscription) error {
+	sharedWatchersLock.Lock()
+	defer sharedWatchersLock.Unlock()
+
+	shared.mutex.Lock()
+	for i, s := range shared.subscriptions {
+		if s == subscription {
+			shared.subscriptions = append(shared.subscriptions[:i], shared.subscriptions[i+1:]...)
+			break
+		}
+	}
+	remaining := len(shared.subscriptions)
+	shared.mutex.Unlock()
+
+	if remaining > 0 {
+		subscription.removeGlobs()
+		return nil
+	}
+	if sharedWatchers[shared.key] == shared {
+		delete(sharedWatchers, shared.key)
+	}
+	return shared.watcher.Close()
+}
+
+// FileCount returns the number of watched files matching the globs of the subscription
+func (subscription *watchSubscription) FileCount() int {
+	count := 0
+	for _, fPath := range subscription.shared.watcher.watchedPaths() {
+		if subscription.matcher.Match(fPath) {
+			count++
+		}
+	}
+	return count
+}
+
+func (subscription *watchSubscription) CreateChangeChannel() chan string {
+	newChan := make(chan string, 20)
+	subscription.callbackLock.Lock()
+	subscription.changeChans = append(subscription.changeChans, newChan)
+	subscription.callbackLock.Unlock()
+	return newChan
+}
+
+func (subscription *watchSubscription) Close() error {
+	var err error
+	subscription.closeOnce.Do(func() {
+		err = subscription.shared.unsubscribe(subscription)
+	})
+	return err
+}
+
+func (subscription *watchSubscription) AddCallback(cb func(string)) {
+	subscription.addOpCallback(func(filePath string, op string) {
+		cb(filePath)
+	})
+}
+
+// addOpCallback adds a callback getting the changes along with their kind
+func (subscription *watchSubscription) addOpCallback(cb func(string, string)) {
+	subscription.callbackLock.Lock()
+	subscription.callbackFuncs = append(subscription.callbackFuncs, cb)
+	subscription.callbackLock.Unlock()
+}
+
+func (subscription *watchSubscription) changeDetected(filePath string, op string) {
+	subscription.callbackLock.Lock()
+	defer subscription.callbackLock.Unlock()
+
+	for _, cb := range subscription.callbackFuncs {
+		go cb(filePath, op)
+	}
+
+	for _, ch := range subscription.changeChans {
+		select {
+		case ch <- filePath:
+		default:
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package wado
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mktange/wado/internal/pkg/util"
+)
+
+// Problem is an issue found in a configuration. Value is the part of the
+// configuration the problem is about, which can be used to locate it in the file.
+type Problem struct {
+	Instance string
+	Value    string
+	Message  string
+	Warning  bool
+}
+
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	if p.Instance == "" {
+		return fmt.Sprintf("%v: %v", level, p.Message)
+	}
+	return fmt.Sprintf("%v: [%v] %v", level, p.Instance, p.Message)
+}
+
+// Problems is a list of problems found in configurations
+type Problems []Problem
+
+// HasErrors returns true if any of the problems are errors, and not just warnings
+func (problems Problems) HasErrors() bool {
+	return problems.Err() != nil
+}
+
+// Err returns the first error among the problems, or nil if there are only warnings
+func (problems Problems) Err() error {
+	for _, problem := range problems {
+		if !problem.Warning {
+			return fmt.Errorf("%v", problem)
+		}
+	}
+	return nil
+}
+
+// ValidateConfigs checks the configurations for anything that would keep the
+// instances from running as intended, without starting anything
+func ValidateConfigs(configs []Config) Problems {
+	problems := Problems{}
+
+	names := map[string]bool{}
+	for _, config := range configs {
+		if config.Name == "" {
+			continue
+		}
+		if names[config.Name] {
+			problems = append(problems, Problem{
+				Instance: config.Name,
+				Value:    config.Name,
+				Message:  "duplicate instance name",
+			})
+		}
+		names[config.Name] = true
+	}
+
+	if !problems.HasErrors() {
+		if _, err := SortByDependencies(configs); err != nil {
+			problems = append(problems, Problem{Message: err.Error()})
+		}
+	}
+
+	for _, config := range configs {
+		problems = append(problems, validateConfig(config)...)
+	}
+	return problems
+}
+
+func validateConfig(config Config) Problems {
+	name := displayName(config)
+	problems := Problems{}
+	addErr := func(value string, err error) {
+		problems = append(problems, Problem{Instance: name, Value: value, Message: err.Error()})
+	}
+
+	switch config.Watcher {
+	case "", WatcherAuto, WatcherFsNotify, WatcherPoll:
+	default:
+		addErr(config.Watcher, fmt.Errorf("unknown watcher kind: %v", config.Watcher))
+	}
+
+	if _, err := newDebouncer(0, config.Mode, nil); err != nil {
+		addErr(config.Mode, err)
+	}
+	for _, trigger := range config.Triggers {
+		if _, err := triggerSet([]string{trigger}); err != nil {
+			addErr(trigger, err)
+		}
+	}
+
+	if err := validateDuration("debounce", config.Debounce); err != nil {
+		addErr("debounce:", err)
+	}
+
+	problems = append(problems, validateGlobs(name, config.IncludeGlobs, config.ExcludeGlobs)...)
+	problems = append(problems, validateCmds(name, config.Cmds)...)
+
+	for _, rule := range config.On {
+		if len(rule.IncludeGlobs) == 0 {
+			addErr("on", fmt.Errorf("rule has no include globs"))
+		}
+		if len(rule.Cmds) == 0 && !rule.RestartMain {
+			value := "on"
+			if len(rule.IncludeGlobs) > 0 {
+				value = rule.IncludeGlobs[0]
+			}
+			addErr(value, fmt.Errorf("rule has neither commands nor restartMain"))
+		}
+		problems = append(problems, validateGlobs(name, rule.IncludeGlobs, rule.ExcludeGlobs)...)
+		problems = append(problems, validateCmds(name, rule.Cmds)...)
+	}
+
+	return problems
+}
+
+func validateGlobs(name string, includeGlobs []string, excludeGlobs []string) Problems {
+	problems := Problems{}
+	for _, glob := range append(append([]string{}, includeGlobs...), excludeGlobs...) {
+		if _, err := absGlobs([]string{glob}); err != nil {
+			problems = append(problems, Problem{
+				Instance: name,
+				Value:    glob,
+				Message:  fmt.Sprintf("invalid glob %v: %v", glob, err),
+			})
+		}
+	}
+
+	for _, glob := range includeGlobs {
+		baseDir := util.GetLowestDirToWatch(glob)
+		if _, err := os.Stat(baseDir); os.IsNotExist(err) {
+			problems = append(problems, Problem{
+				Instance: name,
+				Value:    glob,
+				Message:  fmt.Sprintf("directory %v of glob %v does not exist", baseDir, glob),
+				Warning:  true,
+			})
+		}
+	}
+	return problems
+}
+
+func validateCmds(name string, cmds []CmdConfig) Problems {
+	problems := Problems{}
+	for _, cmd := range cmds {
+		if _, err := NewCmdRunnerFromConfig(cmd); err != nil {
+			problems = append(problems, Problem{
+				Instance: name,
+				Value:    cmd.Run,
+				Message:  fmt.Sprintf("invalid command %v: %v", cmd.Run, err),
+			})
+		}
+
+		errs := []error{validateDuration("timeout", cmd.Timeout)}
+		if cmd.Stop != nil {
+			errs = append(errs, validateDuration("stop timeout", cmd.Stop.Timeout))
+		}
+		if cmd.Ready != nil {
+			errs = append(errs, validateDuration("ready timeout", cmd.Ready.Timeout))
+		}
+		for _, err := range errs {
+			if err != nil {
+				problems = append(problems, Problem{Instance: name, Value: cmd.Run, Message: err.Error()})
+			}
+		}
+	}
+	return problems
+}
+
+// validateDuration rejects durations below a millisecond, which are most likely
+// given in another unit than intended
+func validateDuration(key string, duration time.Duration) error {
+	if duration > 0 && duration < time.Millisecond {
+		return fmt.Errorf("%v of %v is below a millisecond, give it with a unit like 500ms or 2s", key, duration)
+	}
+	return nil
+}
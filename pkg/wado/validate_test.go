@@ -0,0 +1,68 @@
+package wado
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ValidateConfigs(t *testing.T) {
+	problems := ValidateConfigs([]Config{
+		{Name: "api", IncludeGlobs: []string{"./**/*.go"}, Cmds: []CmdConfig{{Run: "go build"}}},
+		{Name: "api", IncludeGlobs: []string{"./[*.go"}},
+		{Name: "web", IncludeGlobs: []string{"./missing/**/*.js"}, Cmds: []CmdConfig{{Run: "echo 'unclosed"}}},
+		{Name: "docs", Watcher: "magic", Mode: "sideways", Triggers: []string{"write", "touch"}},
+		{
+			Name:         "proto",
+			IncludeGlobs: []string{"./*.go"},
+			Debounce:     200,
+			Cmds:         []CmdConfig{{Run: "protoc", Stop: &StopConfig{Timeout: 10 * time.Microsecond}}},
+			On:           []RuleConfig{{IncludeGlobs: []string{"./*.proto", "./*.sql"}}},
+		},
+	})
+
+	messages := []string{}
+	for _, problem := range problems {
+		messages = append(messages, problem.String())
+	}
+	assert.Contains(t, messages, "error: [api] duplicate instance name")
+	assert.Contains(t, messages, "error: [api] invalid glob ./[*.go: syntax error in pattern")
+	assert.Contains(t, messages, "warning: [web] directory missing of glob ./missing/**/*.js does not exist")
+	assert.Contains(t, messages, "error: [docs] unknown watcher kind: magic")
+	assert.Contains(t, messages, "error: [docs] unknown trigger: touch")
+	assert.Contains(t, messages, "error: [proto] debounce of 200ns is below a millisecond, give it with a unit like 500ms or 2s")
+	assert.Contains(t, messages, "error: [proto] stop timeout of 10µs is below a millisecond, give it with a unit like 500ms or 2s")
+	assert.True(t, problems.HasErrors())
+
+	var cmdProblem *Problem
+	for i := range problems {
+		if problems[i].Value == "echo 'unclosed" {
+			cmdProblem = &problems[i]
+		}
+	}
+	if assert.NotNil(t, cmdProblem) {
+		assert.Equal(t, "web", cmdProblem.Instance)
+		assert.False(t, cmdProblem.Warning)
+	}
+
+	var ruleProblem *Problem
+	for i := range problems {
+		if problems[i].Message == "rule has neither commands nor restartMain" {
+			ruleProblem = &problems[i]
+		}
+	}
+	if assert.NotNil(t, ruleProblem) {
+		assert.Equal(t, "./*.proto", ruleProblem.Value)
+	}
+}
+
+func Test_ValidateConfigsWarningsOnly(t *testing.T) {
+	problems := ValidateConfigs([]Config{
+		{Name: "web", IncludeGlobs: []string{"./missing/*.js"}, Cmds: []CmdConfig{{Run: "npm test"}}},
+	})
+	assert.Len(t, problems, 1)
+	assert.True(t, problems[0].Warning)
+	assert.False(t, problems.HasErrors())
+	assert.NoError(t, problems.Err())
+}
@@ -1,111 +1,564 @@
 package wado
 
 import (
+	"fmt"
+	"io"
 	"log"
-	"os"
 	"sync"
 	"time"
+
+	"github.com/mktange/wado/internal/pkg/util"
 )
 
 // Instance listens for changes via the watcher and issues commands to the runner
 type Instance interface {
+	Name() string
+	IsRunning() bool
+	Restart()
+	Pause()
+	Resume()
+	IsPaused() bool
 	Kill()
 }
 
 // Config holds information regarding a specific watcher configuration
 type Config struct {
-	Name         string   `yaml:"name,omitempty"`
-	IncludeGlobs []string `yaml:"include,omitempty"`
-	ExcludeGlobs []string `yaml:"exclude,omitempty"`
-	Cmds         []string `yaml:"cmds,omitempty"`
-	MinDelay     int      `yaml:"minDelay,omitempty"`
+	Name         string        `yaml:"name,omitempty"`
+	Watcher      string        `yaml:"watcher,omitempty"`
+	IncludeGlobs []string      `yaml:"include,omitempty"`
+	ExcludeGlobs []string      `yaml:"exclude,omitempty"`
+	Cmds         []CmdConfig   `yaml:"cmds,omitempty"`
+	On           []RuleConfig  `yaml:"on,omitempty"`
+	DependsOn    []string      `yaml:"dependsOn,omitempty"`
+	MinDelay     int           `yaml:"minDelay,omitempty"`
+	Debounce     time.Duration `yaml:"debounce,omitempty"`
+	Mode         string        `yaml:"mode,omitempty"`
+	Poll         PollConfig    `yaml:"poll,omitempty"`
+	Log          *LogConfig    `yaml:"log,omitempty"`
+
+	// PauseOnGitLock pauses the instance while git is working on the repository
+	PauseOnGitLock bool `yaml:"pauseOnGitLock,omitempty"`
+
+	// GitIgnore makes the watcher skip the files ignored by git, besides the
+	// ones in .wadoignore files which are always skipped
+	GitIgnore bool `yaml:"gitignore,omitempty"`
+
+	// Triggers are the kinds of changes acted on, DefaultTriggers if empty
+	Triggers []string `yaml:"triggers,omitempty"`
+}
+
+// UnmarshalYAML reads a debounce given as a plain number as milliseconds, like minDelay
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainConfig Config
+	if err := unmarshal((*plainConfig)(c)); err != nil {
+		return err
+	}
+	return unmarshalMilliseconds(unmarshal, map[string]*time.Duration{"debounce": &c.Debounce})
+}
+
+// unmarshalMilliseconds reads the durations under the given keys again as
+// milliseconds if they were given as plain numbers, which yaml otherwise reads
+// as nanoseconds
+func unmarshalMilliseconds(unmarshal func(interface{}) error, durations map[string]*time.Duration) error {
+	raw := map[string]interface{}{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	for key, duration := range durations {
+		if ms, ok := raw[key].(int); ok {
+			*duration = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return nil
+}
+
+// RuleConfig holds an extra action of an instance, triggered by changes to the
+// files matching its own globs. The commands run as a side task next to the main
+// chain, and with RestartMain the main chain is restarted once they succeed.
+type RuleConfig struct {
+	IncludeGlobs []string    `yaml:"include,omitempty"`
+	ExcludeGlobs []string    `yaml:"exclude,omitempty"`
+	Cmds         []CmdConfig `yaml:"cmds,omitempty"`
+	RestartMain  bool        `yaml:"restartMain,omitempty"`
 }
 
 type wadoInstance struct {
 	name      string
 	watcher   Watcher
 	cmdChain  CmdChain
-	minDelay  time.Duration
-	lastStart time.Time
+	matcher   *globMatcher
+	debouncer *debouncer
+	rules     []*rule
+	output    *recentOutput
+	logFile   *logFile
+	gitLock   *gitLockMonitor
+	started   bool
+	succeeded bool
+	paused    bool
+	gitLocked bool
+	killed    bool
 	mutex     *sync.Mutex
+
+	// Changes collected while paused, acted on when resumed
+	pending []string
+
+	// Called every time the main chain has run successfully
+	successCallbacks []*func()
+
+	// Called when the instance is killed, to stop listening to its dependencies
+	killCallbacks []func()
 }
 
-// New creates a new wado instance for the given configuration
+type rule struct {
+	matcher     *globMatcher
+	debouncer   *debouncer
+	cmdChain    CmdChain
+	restartMain bool
+
+	// Held while the chain restarts, so overlapping triggers do not restart it at once
+	mutex *sync.Mutex
+}
+
+// New creates and starts a new wado instance for the given configuration
 func New(config Config) (Instance, error) {
+	instance, err := newInstance(config)
+	if err != nil {
+		return nil, err
+	}
+	err = instance.start()
+	if err != nil {
+		instance.Kill()
+		return nil, err
+	}
+	return instance, nil
+}
+
+// newInstance creates a new wado instance, which does not act on changes before it is started
+func newInstance(config Config) (instance *wadoInstance, err error) {
 	name := config.Name
 	if name == "" {
 		name = "Wado"
 	}
 
-	watcher, err := NewPollWatcher(config.IncludeGlobs, config.ExcludeGlobs)
+	// MinDelay is the debounce in milliseconds from before it could be given as a duration
+	debounce := config.Debounce
+	if debounce <= 0 {
+		debounce = time.Duration(config.MinDelay) * time.Millisecond
+	}
+	if debounce <= 0 {
+		debounce = 50 * time.Millisecond
+	}
+
+	wado := &wadoInstance{
+		name:   name,
+		rules:  []*rule{},
+		output: newRecentOutput(),
+		mutex:  &sync.Mutex{},
+	}
+
+	if config.Log != nil {
+		wado.logFile = newLogFile(name, *config.Log)
+
+		// The log path stays registered until the file is closed, which killing
+		// the instance does, but an instance that failed is never killed
+		defer func() {
+			if err != nil {
+				wado.logFile.Close()
+			}
+		}()
+	}
+
+	wado.cmdChain, err = wado.newChain(config.Cmds)
 	if err != nil {
 		return nil, err
 	}
-
-	cmdChain, err := NewCmdChain(config.Cmds...)
+	wado.matcher, err = newGlobMatcher(config.IncludeGlobs, config.ExcludeGlobs)
 	if err != nil {
 		return nil, err
 	}
-	cmdChain.SetWriter(os.Stdout)
-
-	minDelay := config.MinDelay
-	if minDelay <= 0 {
-		minDelay = 50
+	wado.debouncer, err = newDebouncer(debounce, config.Mode, wado.restart)
+	if err != nil {
+		return nil, err
 	}
 
-	wado := &wadoInstance{
-		name:      name,
-		watcher:   watcher,
-		cmdChain:  cmdChain,
-		minDelay:  time.Duration(minDelay) * time.Millisecond,
-		lastStart: time.Unix(0, 0),
-		mutex:     &sync.Mutex{},
+	// All rules share the watcher of the instance, which watches the files of all of them
+	includeGlobs := append([]string{}, config.IncludeGlobs...)
+	for _, ruleConfig := range config.On {
+		r, err := wado.newRule(ruleConfig, debounce, config.Mode)
+		if err != nil {
+			return nil, err
+		}
+		wado.rules = append(wado.rules, r)
+		includeGlobs = append(includeGlobs, ruleConfig.IncludeGlobs...)
 	}
 
-	watcher.AddCallback(wado.changeEvent)
-	err = wado.start()
+	wado.watcher, err = NewWatcher(config.Watcher, includeGlobs, commonExcludeGlobs(config), config.GitIgnore, config.Triggers, config.Poll)
 	if err != nil {
 		return nil, err
 	}
 
+	if watcher, ok := wado.watcher.(opWatcher); ok {
+		watcher.addOpCallback(wado.changeEvent)
+	} else {
+		wado.watcher.AddCallback(func(filePath string) { wado.changeEvent(filePath, "") })
+	}
+
+	if config.PauseOnGitLock {
+		if gitDir := util.FindGitDir("."); gitDir != "" {
+			wado.gitLock = newGitLockMonitor(gitDir, wado.setGitLocked)
+		} else {
+			log.Printf("[%v] Not pausing on git lock, as it is not in a git repository\n", name)
+		}
+	}
+
 	// fmt.Printf("[%v] Currently watching %v files.\n", wado.name, watcher.FileCount())
 
 	return wado, nil
 }
 
+// commonExcludeGlobs returns the exclude globs shared by the instance and all of
+// its rules. Only those can be left out by the watcher, as the instance and each
+// rule apply their own excludes when matching the changes.
+func commonExcludeGlobs(config Config) []string {
+	common := []string{}
+	for _, glob := range config.ExcludeGlobs {
+		inAll := true
+		for _, ruleConfig := range config.On {
+			inAll = inAll && containsString(ruleConfig.ExcludeGlobs, glob)
+		}
+		if inAll {
+			common = append(common, glob)
+		}
+	}
+	return common
+}
+
+// newChain creates a chain of the instance, writing to the recent output, the
+// log file if any, and to stdout and stderr with every line labeled with the
+// instance and command
+func (m *wadoInstance) newChain(cmds []CmdConfig) (CmdChain, error) {
+	cmdChain, err := NewCmdChainFromConfigs(cmds...)
+	if err != nil {
+		return nil, err
+	}
+	cmdChain.SetStepWriters(func(step CmdConfig) (io.Writer, io.Writer) {
+		stdout, stderr := stdOutputMux.Writers(m.name, step.StepName())
+		if m.logFile != nil {
+			logOut, logErr := m.logFile.Writers()
+			return io.MultiWriter(stdout, m.output, logOut), io.MultiWriter(stderr, m.output, logErr)
+		}
+		return io.MultiWriter(stdout, m.output), io.MultiWriter(stderr, m.output)
+	})
+	cmdChain.SetEnv([]string{EnvInstance + "=" + m.name})
+	cmdChain.SetInstanceName(m.name)
+	return cmdChain, nil
+}
+
+func (m *wadoInstance) newRule(config RuleConfig, debounce time.Duration, mode string) (*rule, error) {
+	if len(config.IncludeGlobs) == 0 {
+		return nil, fmt.Errorf("rule in %v has no include globs", m.name)
+	}
+	if len(config.Cmds) == 0 && !config.RestartMain {
+		return nil, fmt.Errorf("rule in %v has neither commands nor restartMain", m.name)
+	}
+
+	r := &rule{restartMain: config.RestartMain, mutex: &sync.Mutex{}}
+
+	var err error
+	r.cmdChain, err = m.newChain(config.Cmds)
+	if err != nil {
+		return nil, err
+	}
+	r.matcher, err = newGlobMatcher(config.IncludeGlobs, config.ExcludeGlobs)
+	if err != nil {
+		return nil, err
+	}
+	r.debouncer, err = newDebouncer(debounce, mode, func(changedFiles []string) {
+		m.runRule(r, changedFiles)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Name returns the name of the instance
+func (m *wadoInstance) Name() string {
+	return m.name
+}
+
+// IsRunning returns true if the main chain of the instance is currently running
+func (m *wadoInstance) IsRunning() bool {
+	return m.cmdChain.IsRunning()
+}
+
+// Restart restarts the main chain of the instance, as if a file had changed
+func (m *wadoInstance) Restart() {
+	m.restart(nil)
+}
+
+// Pause stops the instance from acting on changes until it is resumed. The
+// changes are collected in the meantime.
+func (m *wadoInstance) Pause() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.paused = true
+}
+
+// Resume makes the instance act on changes again after being paused, and
+// triggers a single run for all the changes collected while paused
+func (m *wadoInstance) Resume() {
+	m.mutex.Lock()
+	m.paused = false
+	m.mutex.Unlock()
+	m.runPending()
+}
+
+// IsPaused returns true if the instance is paused, either explicitly or while git is working
+func (m *wadoInstance) IsPaused() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.paused || m.gitLocked
+}
+
+func (m *wadoInstance) setGitLocked(locked bool) {
+	m.mutex.Lock()
+	m.gitLocked = locked
+	m.mutex.Unlock()
+	if !locked {
+		m.runPending()
+	}
+}
+
+// runPending acts on the changes collected while paused, unless still paused.
+// The main chain and every rule are triggered at most once for all the changes.
+func (m *wadoInstance) runPending() {
+	m.mutex.Lock()
+	if m.paused || m.gitLocked || len(m.pending) == 0 {
+		m.mutex.Unlock()
+		return
+	}
+	changedFiles := m.pending
+	m.pending = nil
+	m.mutex.Unlock()
+
+	go func() {
+		if files := m.matcher.Filter(changedFiles); len(files) > 0 {
+			m.restart(files)
+		}
+		for _, r := range m.rules {
+			if files := r.matcher.Filter(changedFiles); len(files) > 0 {
+				m.runRule(r, files)
+			}
+		}
+	}()
+}
+
+func (m *wadoInstance) isStarted() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.started
+}
+
 func (m *wadoInstance) start() error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	m.lastStart = time.Now()
-	return m.cmdChain.Start()
+	if m.started || m.killed {
+		return nil
+	}
+
+	err := m.cmdChain.Start()
+	if err != nil {
+		return err
+	}
+	m.started = true
+	m.notifyOnSuccess()
+	return nil
+}
+
+// onSuccess adds a callback for every time the main chain has run successfully,
+// and returns a function removing it again
+func (m *wadoInstance) onSuccess(cb func()) func() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.successCallbacks = append(m.successCallbacks, &cb)
+
+	return func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		for i, c := range m.successCallbacks {
+			if c == &cb {
+				m.successCallbacks = append(m.successCallbacks[:i:i], m.successCallbacks[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// onKill adds a callback for when the instance is killed
+func (m *wadoInstance) onKill(cb func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.killCallbacks = append(m.killCallbacks, cb)
 }
 
-func (m *wadoInstance) changeEvent(filePath string) {
+// hasSucceeded returns true if the main chain has run successfully at least once
+func (m *wadoInstance) hasSucceeded() bool {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	return m.succeeded
+}
 
-	if time.Since(m.lastStart) >= m.minDelay {
-		err := m.cmdChain.Restart()
-		if err != nil {
-			log.Println("Error while restarting command chain:", err)
+// notifyOnSuccess calls the success callbacks if the current run of the main
+// chain succeeds. Must hold the mutex, so the chain is not restarted before
+// getting hold of the current run.
+func (m *wadoInstance) notifyOnSuccess() {
+	waitReady := m.cmdChain.ReadyWaiter()
+	go func() {
+		if !waitReady().Success() {
 			return
 		}
-		m.lastStart = time.Now()
+
+		m.mutex.Lock()
+		m.succeeded = true
+		callbacks := m.successCallbacks
+		m.mutex.Unlock()
+
+		for _, cb := range callbacks {
+			(*cb)()
+		}
+	}()
+}
+
+// changeEvent passes the changed file on to the main chain and the rules matching it,
+// or collects it for later if the instance is paused. The op is the kind of change.
+func (m *wadoInstance) changeEvent(filePath string, op string) {
+	if isLogFile(filePath) {
+		return
+	}
+	if m.matchesAny(filePath) {
+		emitEvent(Event{Type: EventFileChanged, Instance: m.name, Path: filePath, Op: op})
+	}
+
+	m.mutex.Lock()
+	if m.paused || m.gitLocked {
+		if !containsString(m.pending, filePath) {
+			m.pending = append(m.pending, filePath)
+		}
+		m.mutex.Unlock()
+		return
+	}
+	m.mutex.Unlock()
+
+	if m.matcher.Match(filePath) {
+		m.debouncer.Add(filePath)
+	}
+	for _, r := range m.rules {
+		if r.matcher.Match(filePath) {
+			r.debouncer.Add(filePath)
+		}
+	}
+}
+
+// matchesAny returns true if the path matches the main chain or any of the rules
+func (m *wadoInstance) matchesAny(filePath string) bool {
+	if m.matcher.Match(filePath) {
+		return true
+	}
+	for _, r := range m.rules {
+		if r.matcher.Match(filePath) {
+			return true
+		}
 	}
+	return false
 }
 
-// Kill stops the current running command chain and closes the watcher
+// restart restarts the main command chain for the given changes
+func (m *wadoInstance) restart(changedFiles []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Changes are ignored until the instance is started, e.g. by its dependencies
+	if m.killed || !m.started {
+		return
+	}
+
+	err := m.cmdChain.Restart(relativeFiles(changedFiles)...)
+	if err != nil {
+		log.Println("Error while restarting command chain:", err)
+		return
+	}
+	m.notifyOnSuccess()
+}
+
+// runRule restarts the side task of the rule, and if set, restarts the main
+// chain once the side task has succeeded
+func (m *wadoInstance) runRule(r *rule, changedFiles []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	err := r.cmdChain.Restart(relativeFiles(changedFiles)...)
+	if err != nil {
+		log.Println("Error while restarting command chain:", err)
+		return
+	}
+
+	if r.restartMain {
+		waitReady := r.cmdChain.ReadyWaiter()
+		go func() {
+			if waitReady().Success() {
+				m.restart(changedFiles)
+			}
+		}()
+	}
+}
+
+func relativeFiles(files []string) []string {
+	result := []string{}
+	for _, file := range files {
+		result = append(result, util.RelativeToWorkDir(file))
+	}
+	return result
+}
+
+// Kill stops the current running command chains and closes the watcher
 func (m *wadoInstance) Kill() {
+	m.mutex.Lock()
+	m.killed = true
+	killCallbacks := m.killCallbacks
+	m.killCallbacks = nil
+	m.mutex.Unlock()
+
+	for _, cb := range killCallbacks {
+		cb()
+	}
+
+	if m.gitLock != nil {
+		m.gitLock.Stop()
+	}
+
 	wg := sync.WaitGroup{}
-	wg.Add(2)
+	wg.Add(2 + len(m.rules))
 	go func() {
+		m.debouncer.Stop()
 		m.cmdChain.Kill()
 		wg.Done()
 	}()
+	for _, r := range m.rules {
+		go func(r *rule) {
+			r.debouncer.Stop()
+			r.cmdChain.Kill()
+			wg.Done()
+		}(r)
+	}
 	go func() {
 		m.watcher.Close()
 		wg.Done()
 	}()
 	wg.Wait()
+
+	if m.logFile != nil {
+		m.logFile.Close()
+	}
 }
@@ -0,0 +1,147 @@
+package wado
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mktange/wado/internal/pkg/syncimpls"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_InstanceRules(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	goFile := filepath.Join(tmpDir, "a.go")
+	protoFile := filepath.Join(tmpDir, "a.proto")
+	require.NoError(t, ioutil.WriteFile(goFile, []byte("a"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(protoFile, []byte("a"), os.ModePerm))
+
+	m, err := newInstance(Config{
+		Name:         "Test",
+		IncludeGlobs: []string{filepath.Join(tmpDir, "*.go")},
+		Cmds:         []CmdConfig{{Run: "echo Main"}},
+		On: []RuleConfig{
+			{
+				IncludeGlobs: []string{filepath.Join(tmpDir, "*.proto")},
+				Cmds:         []CmdConfig{{Run: "echo Proto {{.File}}"}},
+			},
+			{
+				IncludeGlobs: []string{filepath.Join(tmpDir, "*.sql")},
+				RestartMain:  true,
+			},
+		},
+		Debounce: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer m.Kill()
+
+	// The writers are set before starting, as the chains are running after that
+	buffer := syncimpls.NewSyncBuffer()
+	m.cmdChain.SetWriter(buffer)
+	m.rules[0].cmdChain.SetWriter(buffer)
+	require.NoError(t, m.start())
+	m.cmdChain.Wait()
+
+	// A rule with commands runs them as a side task
+	m.changeEvent(protoFile, TriggerWrite)
+	m.rules[0].cmdChain.Wait()
+	assert.Contains(t, buffer.String(), "Proto "+protoFile+"\n")
+	assert.Equal(t, 1, strings.Count(buffer.String(), "Main"))
+
+	// A rule without commands restarts the main chain
+	m.changeEvent(filepath.Join(tmpDir, "a.sql"), TriggerWrite)
+	<-time.After(50 * time.Millisecond)
+	m.cmdChain.Wait()
+	assert.Equal(t, 2, strings.Count(buffer.String(), "Main"))
+
+	// Files matched by the instance itself restart the main chain
+	m.changeEvent(goFile, TriggerWrite)
+	m.cmdChain.Wait()
+	assert.Equal(t, 3, strings.Count(buffer.String(), "Main"))
+}
+
+func Test_InstanceRuleInMainExcludes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	genDir := filepath.Join(tmpDir, "gen")
+	genFile := filepath.Join(genDir, "a.go")
+	require.NoError(t, os.Mkdir(genDir, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(genFile, []byte("a"), os.ModePerm))
+
+	m, err := newInstance(Config{
+		Name:         "Test",
+		IncludeGlobs: []string{filepath.Join(tmpDir, "**", "*.go")},
+		ExcludeGlobs: []string{filepath.Join(genDir, "**")},
+		Cmds:         []CmdConfig{{Run: "echo Main"}},
+		On: []RuleConfig{
+			{
+				IncludeGlobs: []string{filepath.Join(genDir, "*.go")},
+				Cmds:         []CmdConfig{{Run: "echo Gen"}},
+			},
+		},
+		Debounce: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer m.Kill()
+
+	buffer := syncimpls.NewSyncBuffer()
+	m.cmdChain.SetWriter(buffer)
+	m.rules[0].cmdChain.SetWriter(buffer)
+	require.NoError(t, m.start())
+	m.cmdChain.Wait()
+
+	// The file is excluded by the instance, but still watched for the rule
+	require.NoError(t, ioutil.WriteFile(genFile, []byte("b"), os.ModePerm))
+	<-time.After(200 * time.Millisecond)
+	m.rules[0].cmdChain.Wait()
+	assert.Equal(t, "Main\nGen\n", buffer.String())
+}
+
+func Test_InstancePause(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	m, err := newInstance(Config{
+		Name:         "Test",
+		IncludeGlobs: []string{filepath.Join(tmpDir, "*.go")},
+		Cmds:         []CmdConfig{{Run: "echo Main {{.Files}}"}},
+		Debounce:     10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer m.Kill()
+
+	buffer := syncimpls.NewSyncBuffer()
+	m.cmdChain.SetWriter(buffer)
+	require.NoError(t, m.start())
+	m.cmdChain.Wait()
+
+	var instance Instance = m
+
+	// Changes are collected while paused
+	instance.Pause()
+	assert.True(t, instance.IsPaused())
+	m.changeEvent(filepath.Join(tmpDir, "a.go"), TriggerWrite)
+	m.changeEvent(filepath.Join(tmpDir, "b.go"), TriggerWrite)
+	m.changeEvent(filepath.Join(tmpDir, "a.go"), TriggerWrite)
+	m.changeEvent(filepath.Join(tmpDir, "c.txt"), TriggerWrite)
+	<-time.After(50 * time.Millisecond)
+	assert.Equal(t, 1, strings.Count(buffer.String(), "Main"))
+
+	// Resuming triggers a single run for all of them
+	instance.Resume()
+	assert.False(t, instance.IsPaused())
+	<-time.After(50 * time.Millisecond)
+	m.cmdChain.Wait()
+	assert.Equal(t, 2, strings.Count(buffer.String(), "Main"))
+	assert.Contains(t, buffer.String(), "Main "+filepath.Join(tmpDir, "a.go")+" "+filepath.Join(tmpDir, "b.go")+"\n")
+}
@@ -1,5 +1,13 @@
 package wado
 
+import (
+	"fmt"
+	"log"
+
+	"github.com/mktange/wado/internal/pkg/ignore"
+	"github.com/mktange/wado/internal/pkg/util"
+)
+
 // Watcher watches a directories and files for changes and posts them to
 // the channel gotten with GetChannel(). The string posted is the path of the changed file.
 type Watcher interface {
@@ -8,3 +16,103 @@ type Watcher interface {
 	Close() error
 	AddCallback(func(string))
 }
+
+// opWatcher is a watcher that can also pass on the kind of each change
+type opWatcher interface {
+	Watcher
+	addOpCallback(func(filePath string, op string))
+}
+
+// The kinds of watchers that can be created with NewWatcher
+const (
+	WatcherAuto     = "auto"
+	WatcherFsNotify = "fsnotify"
+	WatcherPoll     = "poll"
+)
+
+// The kinds of changes to files that can trigger an instance
+const (
+	TriggerCreate = "create"
+	TriggerWrite  = "write"
+	TriggerRemove = "remove"
+	TriggerRename = "rename"
+	TriggerChmod  = "chmod"
+)
+
+// DefaultTriggers are the changes triggering an instance when none are configured
+var DefaultTriggers = []string{TriggerCreate, TriggerWrite, TriggerRemove, TriggerRename}
+
+// triggerSet returns the triggers as a set, or the default ones if there are none
+func triggerSet(triggers []string) (map[string]bool, error) {
+	if len(triggers) == 0 {
+		triggers = DefaultTriggers
+	}
+	set := map[string]bool{}
+	for _, trigger := range triggers {
+		switch trigger {
+		case TriggerCreate, TriggerWrite, TriggerRemove, TriggerRename, TriggerChmod:
+			set[trigger] = true
+		default:
+			return nil, fmt.Errorf("unknown trigger: %v", trigger)
+		}
+	}
+	return set, nil
+}
+
+// changeOf returns the kind of change between the old and new stats of a file,
+// as given by util.HasChanged
+func changeOf(oldFs *util.FileStats, newFs *util.FileStats) string {
+	switch {
+	case newFs == nil:
+		return TriggerRemove
+	case newFs.Hash == oldFs.Hash:
+		return TriggerChmod
+	default:
+		return TriggerWrite
+	}
+}
+
+// NewWatcher creates a watcher of the given kind. The auto kind uses fsnotify
+// when possible, and falls back to polling if the OS has run out of watches
+// or if any of the watched directories are on a network mounted filesystem.
+// The poll config is only used if the watcher ends up polling. With gitIgnore,
+// the files ignored by git are not watched. The watchers with the same kind and
+// settings are shared, so every file is only scanned and hashed once. Only the
+// given kinds of changes are posted, or the default ones if none are given.
+func NewWatcher(kind string, includeGlobs []string, excludeGlobs []string, gitIgnore bool, triggers []string, pollConfig PollConfig) (Watcher, error) {
+	switch kind {
+	case WatcherPoll:
+		return newSharedWatcher(WatcherPoll, includeGlobs, excludeGlobs, gitIgnore, triggers, pollConfig)
+	case WatcherFsNotify:
+		return newSharedWatcher(WatcherFsNotify, includeGlobs, excludeGlobs, gitIgnore, triggers, pollConfig)
+	case WatcherAuto, "":
+	default:
+		return nil, fmt.Errorf("unknown watcher kind: %v", kind)
+	}
+
+	for _, glob := range includeGlobs {
+		isNetwork, err := util.IsNetworkFS(util.GetLowestDirToWatch(glob))
+		if err == nil && isNetwork {
+			log.Printf("Watching %v on a network filesystem, falling back to polling\n", glob)
+			return newSharedWatcher(WatcherPoll, includeGlobs, excludeGlobs, gitIgnore, triggers, pollConfig)
+		}
+	}
+
+	watcher, err := newSharedWatcher(WatcherFsNotify, includeGlobs, excludeGlobs, gitIgnore, triggers, pollConfig)
+	if err != nil && util.IsWatchLimitError(err) {
+		log.Println("Could not use fsnotify, falling back to polling:", err)
+		return newSharedWatcher(WatcherPoll, includeGlobs, excludeGlobs, gitIgnore, triggers, pollConfig)
+	}
+	return watcher, err
+}
+
+// newIgnoreMatcher creates the matcher for the ignore files, starting from the
+// root of the git repository the working directory is in, or else from the
+// working directory
+func newIgnoreMatcher(gitIgnore bool) *ignore.Matcher {
+	root := util.FindRepoRoot(".")
+	if root == "" {
+		root = "."
+	}
+	return ignore.NewMatcher(root, gitIgnore)
+}
@@ -0,0 +1,160 @@
+package wado
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mktange/wado/internal/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewWatcherKinds(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	glob := filepath.Join(tmpDir, "**", "*.go")
+
+	watcher, err := NewWatcher(WatcherPoll, []string{glob}, []string{}, false, nil, PollConfig{})
+	require.NoError(t, err)
+	assert.IsType(t, &pollWatcher{}, watcher.(*watchSubscription).shared.watcher)
+	watcher.Close()
+
+	watcher, err = NewWatcher(WatcherFsNotify, []string{glob}, []string{}, false, nil, PollConfig{})
+	require.NoError(t, err)
+	assert.IsType(t, &fsnotifyWatcher{}, watcher.(*watchSubscription).shared.watcher)
+	watcher.Close()
+
+	watcher, err = NewWatcher(WatcherAuto, []string{glob}, []string{}, false, nil, PollConfig{})
+	require.NoError(t, err)
+	assert.IsType(t, &fsnotifyWatcher{}, watcher.(*watchSubscription).shared.watcher)
+	watcher.Close()
+
+	_, err = NewWatcher("inotify", []string{glob}, []string{}, false, nil, PollConfig{})
+	assert.Error(t, err)
+}
+
+func Test_NewWatcherShared(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "sub"), os.ModePerm))
+	goFile := filepath.Join(tmpDir, "sub", "a.go")
+	txtFile := filepath.Join(tmpDir, "a.txt")
+	require.NoError(t, ioutil.WriteFile(goFile, []byte("a"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(txtFile, []byte("a"), os.ModePerm))
+
+	goWatcher, err := NewWatcher(WatcherFsNotify, []string{filepath.Join(tmpDir, "**", "*.go")}, []string{}, false, nil, PollConfig{})
+	require.NoError(t, err)
+	allWatcher, err := NewWatcher(WatcherFsNotify, []string{filepath.Join(tmpDir, "**", "*")}, []string{}, false, nil, PollConfig{})
+	require.NoError(t, err)
+
+	// Both get their files from the same watcher
+	shared := goWatcher.(*watchSubscription).shared
+	assert.Equal(t, shared, allWatcher.(*watchSubscription).shared)
+	assert.Equal(t, 2, len(shared.watcher.watchedPaths()))
+	assert.Equal(t, 1, goWatcher.FileCount())
+	assert.Equal(t, 2, allWatcher.FileCount())
+
+	goChan := goWatcher.CreateChangeChannel()
+	allChan := allWatcher.CreateChangeChannel()
+
+	// Changes only go to the watchers whose globs match them
+	require.NoError(t, ioutil.WriteFile(txtFile, []byte("b"), os.ModePerm))
+	assert.True(t, util.WaitForMessage(t, allChan), "Change did not appear on channel")
+	assert.False(t, util.WaitForMessage(t, goChan), "Change should not appear on channel")
+
+	require.NoError(t, ioutil.WriteFile(goFile, []byte("b"), os.ModePerm))
+	assert.True(t, util.WaitForMessage(t, allChan), "Change did not appear on channel")
+	assert.True(t, util.WaitForMessage(t, goChan), "Change did not appear on channel")
+
+	// The shared watcher is closed along with the last of them
+	require.NoError(t, goWatcher.Close())
+	assert.False(t, shared.watcher.(*fsnotifyWatcher).isClosed())
+	require.NoError(t, allWatcher.Close())
+	assert.True(t, shared.watcher.(*fsnotifyWatcher).isClosed())
+
+	sharedWatchersLock.Lock()
+	_, exists := sharedWatchers[shared.key]
+	sharedWatchersLock.Unlock()
+	assert.False(t, exists)
+}
+
+func Test_NewWatcherSharedReload(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	docsDir := filepath.Join(tmpDir, "docs")
+	require.NoError(t, os.Mkdir(srcDir, os.ModePerm))
+	require.NoError(t, os.Mkdir(docsDir, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcDir, "a.go"), []byte("a"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(docsDir, "a.md"), []byte("a"), os.ModePerm))
+
+	for _, kind := range []string{WatcherFsNotify, WatcherPoll} {
+		wideWatcher, err := NewWatcher(kind, []string{filepath.Join(tmpDir, "**", "*")}, []string{}, false, nil, PollConfig{})
+		require.NoError(t, err)
+		shared := wideWatcher.(*watchSubscription).shared
+		assert.Len(t, shared.watcher.watchedPaths(), 2)
+
+		// A failing subscription leaves nothing behind. Polling is fine with missing directories.
+		missingWatcher, err := NewWatcher(kind, []string{filepath.Join(docsDir, "*.md"), filepath.Join(tmpDir, "missing", "*.go")}, []string{}, false, nil, PollConfig{})
+		if kind == WatcherFsNotify {
+			require.Error(t, err)
+			assert.Len(t, shared.watcher.(*fsnotifyWatcher).globs, 1)
+		} else {
+			require.NoError(t, err)
+			require.NoError(t, missingWatcher.Close())
+		}
+
+		// Reloading with narrower globs stops watching what is no longer needed
+		narrowWatcher, err := NewWatcher(kind, []string{filepath.Join(srcDir, "*.go")}, []string{}, false, nil, PollConfig{})
+		require.NoError(t, err)
+		require.NoError(t, wideWatcher.Close())
+		assert.Equal(t, []string{filepath.Join(srcDir, "a.go")}, shared.watcher.watchedPaths(), kind)
+
+		if kind == WatcherFsNotify {
+			fsWatcher := shared.watcher.(*fsnotifyWatcher)
+			assert.Len(t, fsWatcher.globs, 1)
+			_, watched := fsWatcher.watchedDirs.Load(docsDir)
+			assert.False(t, watched, "Directories no glob needs should no longer be watched")
+			_, watched = fsWatcher.watchedDirs.Load(srcDir)
+			assert.True(t, watched)
+		} else {
+			assert.Len(t, shared.watcher.(*pollWatcher).globs, 1)
+		}
+		require.NoError(t, narrowWatcher.Close())
+	}
+}
+
+func Test_NewWatcherTriggers(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "wado-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	goFile := filepath.Join(tmpDir, "a.go")
+	require.NoError(t, ioutil.WriteFile(goFile, []byte("a"), os.ModePerm))
+
+	glob := filepath.Join(tmpDir, "*.go")
+	writeWatcher, err := NewWatcher(WatcherFsNotify, []string{glob}, []string{}, false, []string{TriggerWrite}, PollConfig{})
+	require.NoError(t, err)
+	defer writeWatcher.Close()
+	defaultWatcher, err := NewWatcher(WatcherFsNotify, []string{glob}, []string{}, false, nil, PollConfig{})
+	require.NoError(t, err)
+	defer defaultWatcher.Close()
+
+	writeChan := writeWatcher.CreateChangeChannel()
+	defaultChan := defaultWatcher.CreateChangeChannel()
+
+	require.NoError(t, os.Remove(goFile))
+	assert.True(t, util.WaitForMessage(t, defaultChan), "Change did not appear on channel")
+	assert.False(t, util.WaitForMessage(t, writeChan), "Change should not appear on channel")
+
+	_, err = NewWatcher(WatcherFsNotify, []string{glob}, []string{}, false, []string{"touch"}, PollConfig{})
+	assert.Error(t, err)
+}